@@ -0,0 +1,101 @@
+// BP35Cx-J11を使ってスマートメータから電力消費量などを得る
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 Akihiro Yamamoto <github.com/ak1211>
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 送受信の向き
+const (
+	CaptureRx = "rx" // 受信
+	CaptureTx = "tx" // 送信
+)
+
+// 送受信したechonet lite電文をファイルに記録する
+// 1行に1つの電文を"日時 向き 16進数文字列"の形式で書く
+// 例: 2025-01-02T15:04:05.123456789+09:00 rx 1081000102880105ff017201e70400000190
+type FrameCapture struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewFrameCapture(w io.Writer) *FrameCapture {
+	return &FrameCapture{w: w}
+}
+
+// 電文を記録する
+// nilなら何もしない(記録しない既定の動作)
+func (c *FrameCapture) Record(direction string, b []byte) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.w == nil { // 閉じた後
+		return
+	}
+	if _, err := fmt.Fprintf(c.w, "%s %s %s\n", time.Now().Format(time.RFC3339Nano), direction, hex.EncodeToString(b)); err != nil {
+		slog.Warn("capture", "err", err)
+	}
+}
+
+// 記録をやめて、記録先がio.Closerなら閉じる
+// nilなら何もしない
+func (c *FrameCapture) Close() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w := c.w
+	c.w = nil
+	if closer, ok := w.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// 記録した1つの電文
+type CapturedFrame struct {
+	Time      time.Time
+	Direction string
+	Data      []byte
+}
+
+// FrameCaptureで記録した形式を読む
+// 記録した形式でない行があればfalseを返す
+func parseCapture(r io.Reader) ([]CapturedFrame, bool) {
+	var frames []CapturedFrame
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 || (fields[1] != CaptureRx && fields[1] != CaptureTx) {
+			return nil, false
+		}
+		t, err := time.Parse(time.RFC3339Nano, fields[0])
+		if err != nil {
+			return nil, false
+		}
+		b, err := hex.DecodeString(fields[2])
+		if err != nil {
+			return nil, false
+		}
+		frames = append(frames, CapturedFrame{Time: t, Direction: fields[1], Data: b})
+	}
+	if scanner.Err() != nil || len(frames) == 0 {
+		return nil, false
+	}
+	return frames, true
+}
@@ -0,0 +1,42 @@
+// BP35Cx-J11を使ってスマートメータから電力消費量などを得る
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 Akihiro Yamamoto <github.com/ak1211>
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFrameCaptureClose(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "capture.txt")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	capture := NewFrameCapture(f)
+	capture.Record(CaptureTx, mustDecodeHex(t, "1081 0001 05ff01 028801 62 01 e7 00"))
+	if err := capture.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// 閉じた後の記録は捨てる
+	capture.Record(CaptureRx, mustDecodeHex(t, getResInstantWatt))
+	if _, err := f.Write([]byte{0}); err == nil {
+		t.Error("file is still open after Close")
+	}
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames, ok := parseCapture(strings.NewReader(string(b)))
+	if !ok || len(frames) != 1 || frames[0].Direction != CaptureTx {
+		t.Errorf("captured = %q", b)
+	}
+	// nilなら何もしない
+	var none *FrameCapture
+	if err := none.Close(); err != nil {
+		t.Errorf("nil Close() = %v", err)
+	}
+}
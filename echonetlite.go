@@ -6,11 +6,22 @@ package main
 import (
 	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"math"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
+)
+
+// ECHONETオブジェクト
+var (
+	EojHomeController = [3]byte{0x05, 0xff, 0x01} // コントローラ
+	EojSmartmeter     = [3]byte{0x02, 0x88, 0x01} // 低圧スマート電力量メータ
+	EojNodeProfile    = [3]byte{0x0e, 0xf0, 0x01} // ノードプロファイル
 )
 
 type EchonetliteFrame struct {
@@ -21,19 +32,69 @@ type EchonetliteFrame struct {
 	esv   byte
 	opc   byte
 	edata []EchonetliteEdata
+	// SetGet(0x6e, 0x7e, 0x5e)のときのGet側のプロパティ(edataはSet側)
+	getEdata []EchonetliteEdata
+}
+
+// SetGet系のESVか
+func isSetGet(esv byte) bool {
+	switch esv {
+	case 0x6e, 0x7e, 0x5e: // SetGet, SetGet_res, SetGet_SNA
+		return true
+	}
+	return false
+}
+
+// 書き込むプロパティと読み出すプロパティを1つの電文にしたSetGet要求(0x6e)を作る
+func NewSetGetFrame(deoj [3]byte, set []EchonetliteEdata, epcs []byte) EchonetliteFrame {
+	var get []EchonetliteEdata
+	for _, epc := range epcs {
+		get = append(get, EchonetliteEdata{epc: epc})
+	}
+	return EchonetliteFrame{
+		ehd:      0x1081,
+		seoj:     EojHomeController,
+		deoj:     deoj,
+		esv:      0x6e, // SetGet要求
+		opc:      byte(len(set)),
+		edata:    set,
+		getEdata: get,
+	}
 }
 
 func (e *EchonetliteFrame) Encode() []byte {
-	var b []byte
-	b = binary.BigEndian.AppendUint16(b, e.ehd)
-	b = binary.BigEndian.AppendUint16(b, e.tid)
-	b = append(b, e.seoj[:]...)
-	b = append(b, e.deoj[:]...)
-	b = append(b, e.esv, e.opc)
+	n := 12
 	for _, v := range e.edata {
-		b = append(b, v.Encode()...)
+		n += 2 + len(v.edt)
+	}
+	if isSetGet(e.esv) {
+		n++
+		for _, v := range e.getEdata {
+			n += 2 + len(v.edt)
+		}
+	}
+	return e.AppendEncode(make([]byte, 0, n))
+}
+
+// dstの後ろにechonet lite電文を追加したスライスを返す
+// 呼び出し側でバッファを使いまわせばEncodeのようにその都度確保しない
+func (e *EchonetliteFrame) AppendEncode(dst []byte) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, e.ehd)
+	dst = binary.BigEndian.AppendUint16(dst, e.tid)
+	dst = append(dst, e.seoj[:]...)
+	dst = append(dst, e.deoj[:]...)
+	// opcとedataの数が食い違った電文を送らないように、opcはedataの数から決める
+	dst = append(dst, e.esv, byte(len(e.edata)))
+	for i := range e.edata {
+		dst = e.edata[i].AppendEncode(dst)
+	}
+	if isSetGet(e.esv) {
+		dst = append(dst, byte(len(e.getEdata)))
+		for i := range e.getEdata {
+			dst = e.getEdata[i].AppendEncode(dst)
+		}
 	}
-	return b
+	return dst
 }
 
 type EchonetliteEdata struct {
@@ -43,10 +104,13 @@ type EchonetliteEdata struct {
 }
 
 func (e *EchonetliteEdata) Encode() []byte {
-	var b []byte
-	b = append(b, e.epc, e.pdc)
-	b = append(b, e.edt...)
-	return b
+	return e.AppendEncode(make([]byte, 0, 2+len(e.edt)))
+}
+
+// dstの後ろにEPC, PDC, EDTを追加したスライスを返す
+func (e *EchonetliteEdata) AppendEncode(dst []byte) []byte {
+	dst = append(dst, e.epc, e.pdc)
+	return append(dst, e.edt...)
 }
 
 func ParseEchonetliteFrame(data []byte) (*EchonetliteFrame, error) {
@@ -63,39 +127,69 @@ func ParseEchonetliteFrame(data []byte) (*EchonetliteFrame, error) {
 	deoj := data[7:10]
 	esv := data[10]
 	opc := data[11]
-	props := data[12:]
+	edata, props, err := parseEdata(data[12:], opc)
+	if err != nil {
+		return nil, err
+	}
+	var getEdata []EchonetliteEdata
+	if isSetGet(esv) {
+		// Set側のプロパティに続いてGet側のOPCとプロパティがある
+		if len(props) < 1 {
+			return nil, errors.New("SetGet: missing opc of get properties")
+		}
+		getEdata, _, err = parseEdata(props[1:], props[0])
+		if err != nil {
+			return nil, fmt.Errorf("SetGet: %w", err)
+		}
+	}
+	//
+	return &EchonetliteFrame{
+		ehd:      ehd,
+		tid:      tid,
+		seoj:     [3]byte(seoj),
+		deoj:     [3]byte(deoj),
+		esv:      esv,
+		opc:      opc,
+		edata:    edata,
+		getEdata: getEdata,
+	}, nil
+}
+
+// opc個のプロパティを解釈して残りのバイト列と共に返す
+func parseEdata(props []byte, opc byte) ([]EchonetliteEdata, []byte, error) {
 	var edata []EchonetliteEdata
 	for count := 0; count < int(opc); count++ {
+		if len(props) < 2 {
+			return nil, nil, fmt.Errorf("opc=%d but ran out of bytes at edata %d (remaining %d bytes)", opc, count, len(props))
+		}
+		// byteのまま2を足すとPDCが0xfe,0xffのときに桁あふれするのでintで数える
+		n := int(props[1])
+		if remaining := len(props) - 2; n > remaining {
+			return nil, nil, fmt.Errorf("edata %d: pdc=%d exceeds remaining %d bytes", count, n, remaining)
+		}
 		edata = append(edata, EchonetliteEdata{
-			epc: props[0],              // 要求
-			pdc: props[1],              // データ数
-			edt: props[2 : 2+props[1]], // データ
+			epc: props[0],       // 要求
+			pdc: props[1],       // データ数
+			edt: props[2 : 2+n], // データ
 		})
-		props = props[2+props[1]:]
+		props = props[2+n:]
 	}
-	//
-	return &EchonetliteFrame{
-		ehd:   ehd,
-		tid:   tid,
-		seoj:  [3]byte(seoj),
-		deoj:  [3]byte(deoj),
-		esv:   esv,
-		opc:   opc,
-		edata: edata,
-	}, nil
+	return edata, props, nil
 }
 
 func (e *EchonetliteFrame) Show() {
 	n := len(e.edata)
 	switch e.esv {
 	case 0x50: // SetI_SNA
-		slog.Info("SetI_SNAプロパティ値書き込み要求不可応答", slog.Int("N", n))
+		slog.Info("SetI_SNAプロパティ値書き込み要求不可応答", slog.Int("N", n), slog.String("refused", formatEpcs(e.RefusedEpcs())))
 	case 0x51: // SetC_SNA
-		slog.Info("SetC_SNAプロパティ値書き込み要求不可応答", slog.Int("N", n))
+		slog.Info("SetC_SNAプロパティ値書き込み要求不可応答", slog.Int("N", n), slog.String("refused", formatEpcs(e.RefusedEpcs())))
 	case 0x52: // Get_SNA
-		slog.Info("Get_SNAプロパティ値読み出し不可応答", slog.Int("N", n))
+		slog.Info("Get_SNAプロパティ値読み出し不可応答", slog.Int("N", n), slog.String("refused", formatEpcs(e.RefusedEpcs())))
 	case 0x53: // INF_SNA
 		slog.Info("INF_SNAプロパティ値通知不可応答", slog.Int("N", n))
+	case 0x5e: // SetGet_SNA
+		slog.Info("SetGet_SNAプロパティ値書き込み・読み出し不可応答", slog.Int("N", n), slog.Int("Nget", len(e.getEdata)), slog.String("refused", formatEpcs(e.RefusedEpcs())))
 	case 0x71: // Set_res
 		slog.Info("Set_resプロパティ値書き込み応答", slog.Int("N", n))
 	case 0x72: // Get_res
@@ -104,135 +198,539 @@ func (e *EchonetliteFrame) Show() {
 		slog.Info("INFプロパティ値通知", slog.Int("N", n))
 	case 0x74: // INFC
 		slog.Info("INFCプロパティ値通知(応答要)", slog.Int("N", n))
+	case 0x7e: // SetGet_res
+		slog.Info("SetGet_resプロパティ値書き込み・読み出し応答", slog.Int("N", n), slog.Int("Nget", len(e.getEdata)))
 	default:
 		slog.Debug("よくわからないESV値", slog.Any("frame", e))
 	}
 	for i := 0; i < n; i++ {
 		e.edata[i].Show()
 	}
+	for i := range e.getEdata {
+		e.getEdata[i].Show()
+	}
 }
 
-// EDATA値を表示する
-func (e *EchonetliteEdata) Show() {
+// 不可応答(SNA)で受け付けられなかったEPC
+// 読み出し、通知の不可応答ではPDCが0のプロパティが受け付けられなかったもの
+// 書き込みの不可応答ではPDCが0でない(要求のEDTがそのまま返ってきた)プロパティが受け付けられなかったもの
+// SetGet_SNAではGet側のプロパティについて返す
+func (e *EchonetliteFrame) RefusedEpcs() []byte {
+	var edata []EchonetliteEdata
+	switch e.esv {
+	case 0x50, 0x51: // SetI_SNA, SetC_SNA
+		return refusedSetEpcs(e.edata)
+	case 0x52, 0x53: // Get_SNA, INF_SNA
+		edata = e.edata
+	case 0x5e: // SetGet_SNA
+		edata = e.getEdata
+	default:
+		return nil
+	}
+	var epcs []byte
+	for _, v := range edata {
+		if v.pdc == 0 {
+			epcs = append(epcs, v.epc)
+		}
+	}
+	return epcs
+}
+
+// 書き込みの不可応答で受け付けられなかったEPC
+func refusedSetEpcs(edata []EchonetliteEdata) []byte {
+	var epcs []byte
+	for _, v := range edata {
+		if v.pdc != 0 {
+			epcs = append(epcs, v.epc)
+		}
+	}
+	return epcs
+}
+
+// EPCのリストを表示用の文字列にする
+func formatEpcs(epcs []byte) string {
+	var ss []string
+	for _, epc := range epcs {
+		ss = append(ss, fmt.Sprintf("0x%02x", epc))
+	}
+	return "[" + strings.Join(ss, ",") + "]"
+}
+
+// プロパティ値の読み出し要求が不可応答(Get_SNA)で拒否されたことを示すエラー
+type ErrPropertyNotAvailable struct {
+	Epc byte
+}
+
+func (e *ErrPropertyNotAvailable) Error() string {
+	return fmt.Sprintf("epc:0x%02x property not available", e.Epc)
+}
+
+// プロパティ値の書き込み要求が不可応答(SetC_SNA, SetGet_SNA)で拒否されたことを示すエラー
+type ErrSetRefused struct {
+	Epcs []byte
+}
+
+func (e *ErrSetRefused) Error() string {
+	return fmt.Sprintf("epc:%s set request refused", formatEpcs(e.Epcs))
+}
+
+// 値が無い(N/A)ことを示すエラー
+var ErrValueNotAvailable = errors.New("value not available")
+
+// 解釈できないEPCであることを示すエラー
+var ErrUnknownEpc = errors.New("unknown epc")
+
+// スマートメーターの日時のタイムゾーン
+// スマートメーターはタイムゾーンを持たない日本時間で日時を返すので、
+// ホストのタイムゾーンに関わらず日本標準時として解釈する
+var MeterLocation = time.FixedZone("JST", 9*60*60)
+
+// 瞬時電流計測値(0.1A単位)
+type InstantCurrent struct {
+	R int16 // R相
+	T int16 // T相(単相2線式の場合は0x7ffe)
+}
+
+// 配線方式
+type Wiring int
+
+const (
+	WiringSinglePhaseTwoWire   Wiring = iota + 1 // 単相2線式
+	WiringSinglePhaseThreeWire                   // 単相3線式
+)
+
+func (w Wiring) String() string {
+	switch w {
+	case WiringSinglePhaseTwoWire:
+		return "1φ2W"
+	case WiringSinglePhaseThreeWire:
+		return "1φ3W"
+	default:
+		return "unknown"
+	}
+}
+
+// 瞬時電流計測値から配線方式を判別する
+// 単相2線式ではT相が0x7ffe(値無し)になる
+func (c InstantCurrent) Wiring() Wiring {
+	if c.T == 0x7ffe {
+		return WiringSinglePhaseTwoWire
+	}
+	return WiringSinglePhaseThreeWire
+}
+
+// 単相2線式ならtrue
+func (c InstantCurrent) IsSinglePhaseTwoWire() bool {
+	return c.Wiring() == WiringSinglePhaseTwoWire
+}
+
+// R相の電流(A) 逆方向ならマイナスの値
+func (c InstantCurrent) RAmpere() float64 {
+	return float64(c.R) / 10
+}
+
+// T相の電流(A) 単相2線式ならfalse
+func (c InstantCurrent) TAmpere() (float64, bool) {
+	if c.IsSinglePhaseTwoWire() {
+		return 0, false
+	}
+	return float64(c.T) / 10, true
+}
+
+// 構造化出力ではアンペア単位の小数にする(単相2線式ではTを含めない)
+func (c InstantCurrent) MarshalJSON() ([]byte, error) {
+	v := struct {
+		R      float64  `json:"r"`
+		T      *float64 `json:"t,omitempty"`
+		Wiring string   `json:"wiring"`
+	}{R: c.RAmpere(), Wiring: c.Wiring().String()}
+	if t, ok := c.TAmpere(); ok {
+		v.T = &t
+	}
+	return json.Marshal(v)
+}
+
+// 現在時刻設定(0x97)
+type ClockTime struct {
+	Hour   uint8
+	Minute uint8
+}
+
+// 定時積算電力量計測値
+type FixedTimeCumulative struct {
+	Time  time.Time // 計測日時
+	Value uint64    // 積算電力量計測値
+}
+
+// プロパティマップ(昇順に並んだEPC)
+type PropertyMap []byte
+
+// プロパティマップを解釈する
+// EDT[0] = プロパティの数
+// プロパティの数が16未満ならEDT[1:]にEPCが並ぶ
+// 16以上ならEDT[1:17]が16バイトのビットマップで、
+// EDT[1+i]のビットbがEPC 0x80+0x10*b+iに対応する
+func decodePropertyMap(edt []byte) (PropertyMap, error) {
+	if len(edt) < 1 {
+		return nil, ErrValueNotAvailable
+	}
+	count := int(edt[0])
+	var pm PropertyMap
+	if count < 16 {
+		if len(edt) < 1+count {
+			return nil, ErrValueNotAvailable
+		}
+		pm = append(pm, edt[1:1+count]...)
+		slices.Sort(pm)
+	} else {
+		if len(edt) < 17 {
+			return nil, ErrValueNotAvailable
+		}
+		for b := 0; b < 8; b++ {
+			for i := 0; i < 16; i++ {
+				if edt[1+i]&(1<<b) != 0 {
+					pm = append(pm, byte(0x80+0x10*b+i))
+				}
+			}
+		}
+	}
+	return pm, nil
+}
+
+// EPCが含まれていればtrue
+func (pm PropertyMap) Contains(epc byte) bool {
+	_, found := slices.BinarySearch(pm, epc)
+	return found
+}
+
+func (pm PropertyMap) String() string {
+	ss := make([]string, len(pm))
+	for i, epc := range pm {
+		ss[i] = fmt.Sprintf("%02x", epc)
+	}
+	return fmt.Sprintf("%d個 [", len(pm)) + strings.Join(ss, ",") + "]"
+}
+
+// 積算電力量計測値の換算
+type CumulativeScale struct {
+	Coefficient uint32 // 係数(0xd3) 存在しない場合は1
+	PowersOfTen int    // 積算電力量単位(0xe1) 10の冪指数
+	Digits      uint8  // 積算電力量有効桁数(0xd7) 未取得なら0
+}
+
+// 積算電力量計測値をkWhに換算する
+func (s CumulativeScale) KWh(raw uint64) float64 {
+	return float64(raw) * float64(s.Coefficient) * math.Pow10(s.PowersOfTen)
+}
+
+// 前回から今回までの積算電力量計測値の増分を返す
+// 計測値は有効桁数を超えると0に戻るので、今回の方が小さければ一周したとみなす
+// 有効桁数が分からず一周したかどうか判断できないとき、有効桁数を超えた計測値のときはfalseを返す
+func (s CumulativeScale) Delta(prev, cur uint64) (uint64, bool) {
+	if s.Digits > 19 {
+		return 0, false
+	}
+	if s.Digits > 0 {
+		modulus := uint64(1)
+		for range s.Digits {
+			modulus *= 10
+		}
+		if prev >= modulus || cur >= modulus {
+			return 0, false
+		}
+		if cur < prev {
+			return modulus - prev + cur, true
+		}
+	}
+	if cur < prev {
+		return 0, false
+	}
+	return cur - prev, true
+}
+
+// 積算電力量計測値履歴
+type CumulativeHistory struct {
+	DaysAgo uint16     // 積算履歴収集日(何日前か)
+	Values  [48]uint32 // 30分毎の積算電力量計測値(0xfffffffeは値無し)
+}
+
+// 積算電力量計測値履歴の値無し
+const CumulativeNotAvailable uint32 = 0xfffffffe
+
+// 積算履歴収集日に指定できる最大値
+const MaxHistoryDaysAgo uint8 = 99
+
+// 積算電力量計測値履歴を解釈する
+// EDT[0,1] = 積算履歴収集日
+// EDT[2:194] = 30分毎の積算電力量計測値(4バイト×48コマ)
+func decodeCumulativeHistory(edt []byte) (CumulativeHistory, error) {
+	history := CumulativeHistory{}
+	if len(edt) < 194 {
+		return history, ErrValueNotAvailable
+	}
+	history.DaysAgo = binary.BigEndian.Uint16(edt[0:2])
+	for i := range history.Values {
+		history.Values[i] = binary.BigEndian.Uint32(edt[2+4*i:])
+	}
+	return history, nil
+}
+
+func (h CumulativeHistory) String() string {
+	var ss [48]string
+	for i, v := range h.Values {
+		if v == CumulativeNotAvailable {
+			ss[i] = fmt.Sprintf("%8s", "N/A")
+		} else {
+			ss[i] = fmt.Sprintf("%8d", v)
+		}
+	}
+	return fmt.Sprintf("%d日前[", h.DaysAgo) + strings.Join(ss[:], ",") + "]"
+}
+
+// 積算電力量計測値履歴2(正方向、逆方向計測値)
+type CumulativeHistory2 struct {
+	Time    time.Time // 積算履歴収集日時(この日時のコマから過去に遡る)
+	Forward []uint32  // 30分毎の積算電力量計測値(正方向 0xfffffffeは値無し)
+	Reverse []uint32  // 30分毎の積算電力量計測値(逆方向 0xfffffffeは値無し)
+}
+
+// 積算履歴収集日2
+type HistoryCollectionTime2 struct {
+	Time  time.Time // 積算履歴収集日時(分は0か30)
+	Slots uint8     // 収集コマ数(1～12)
+}
+
+// 積算履歴収集日2に指定できる収集コマ数の最大値
+const MaxHistory2Slots uint8 = 12
+
+// 年月日時分(6バイト)を解釈する
+func decodeDateTimeMinute(edt []byte) (time.Time, bool) {
+	if len(edt) < 6 {
+		return time.Time{}, false
+	}
+	year := binary.BigEndian.Uint16(edt[0:2])
+	month, day, hour, minute := edt[2], edt[3], edt[4], edt[5]
+	if month < 1 || 12 < month || day < 1 || 31 < day || 23 < hour || 59 < minute {
+		return time.Time{}, false
+	}
+	return time.Date(int(year), time.Month(month), int(day), int(hour), int(minute), 0, 0, MeterLocation), true
+}
+
+// 積算履歴収集日2のEDTを作る
+// EDT[0,1] = 年, EDT[2] = 月, EDT[3] = 日, EDT[4] = 時, EDT[5] = 分, EDT[6] = 収集コマ数
+func (h HistoryCollectionTime2) Encode() []byte {
+	b := binary.BigEndian.AppendUint16(nil, uint16(h.Time.Year()))
+	return append(b, byte(h.Time.Month()), byte(h.Time.Day()), byte(h.Time.Hour()), byte(h.Time.Minute()), h.Slots)
+}
+
+// 積算電力量計測値履歴2を解釈する
+// EDT[0:6] = 積算履歴収集日時(年月日時分)
+// EDT[6] = 収集コマ数
+// EDT[7:] = 正方向と逆方向の積算電力量計測値(4バイト+4バイト)×収集コマ数
+func decodeCumulativeHistory2(edt []byte) (CumulativeHistory2, error) {
+	history := CumulativeHistory2{}
+	t, ok := decodeDateTimeMinute(edt)
+	if !ok || len(edt) < 7 {
+		return history, ErrValueNotAvailable
+	}
+	slots := int(edt[6])
+	if slots > int(MaxHistory2Slots) || len(edt) < 7+8*slots {
+		return history, ErrValueNotAvailable
+	}
+	history.Time = t
+	for i := 0; i < slots; i++ {
+		history.Forward = append(history.Forward, binary.BigEndian.Uint32(edt[7+8*i:]))
+		history.Reverse = append(history.Reverse, binary.BigEndian.Uint32(edt[11+8*i:]))
+	}
+	return history, nil
+}
+
+func (h CumulativeHistory2) String() string {
+	format := func(values []uint32) string {
+		ss := make([]string, len(values))
+		for i, v := range values {
+			if v == CumulativeNotAvailable {
+				ss[i] = fmt.Sprintf("%8s", "N/A")
+			} else {
+				ss[i] = fmt.Sprintf("%8d", v)
+			}
+		}
+		return "[" + strings.Join(ss, ",") + "]"
+	}
+	return fmt.Sprintf("%s 正方向%s 逆方向%s", h.Time.Format("2006/01/02 15:04"), format(h.Forward), format(h.Reverse))
+}
+
+// EDATA値を解釈する
+//
+//	0x80: bool (動作中ならtrue)
+//	0x82: string (規格Version情報のリリース番号 例: "J")
+//	0x88: bool (異常発生ありならtrue)
+//	0x8a: [3]byte (製造者コード)
+//	0x8c: string (商品コード)
+//	0x8d: string (製造番号)
+//	0x8e: time.Time (製造年月日)
+//	0x97: ClockTime (現在時刻設定 時:分)
+//	0x98: time.Time (現在年月日設定 時刻は0:00)
+//	0x9d,0x9e,0x9f: PropertyMap (状変アナウンス、Set、Getプロパティマップ)
+//	0xd3: uint32 (係数)
+//	0xd5,0xd6: [][3]byte (インスタンスリスト通知, 自ノードインスタンスリストS)
+//	0xd7: uint8 (積算電力量有効桁数)
+//	0xe0: uint64 (積算電力量計測値(正方向))
+//	0xe1: int (積算電力量単位 10の冪指数 正方向、逆方向共通)
+//	0xe2: CumulativeHistory
+//	0xe3: uint64 (積算電力量計測値(逆方向))
+//	0xe4: CumulativeHistory (逆方向)
+//	0xe5: uint8 (積算履歴収集日1 0は今日、1～99は何日前)
+//	0xe7: int32 (瞬時電力計測値 逆潮流(売電)なら負の値)
+//	0xe8: InstantCurrent
+//	0xea: FixedTimeCumulative
+//	0xec: CumulativeHistory2
+//	0xed: HistoryCollectionTime2
+func (e *EchonetliteEdata) Value() (any, error) {
 	switch e.epc {
 	case 0x80: // 動作状態
-		s := fmt.Sprintf("N/A(epc:0x%02x)", e.epc)
-		switch {
-		case e.edt[0] == 0x30:
-			s = "動作中"
-		case e.edt[0] == 0x31:
-			s = "未動作"
+		if len(e.edt) >= 1 {
+			switch e.edt[0] {
+			case 0x30:
+				return true, nil
+			case 0x31:
+				return false, nil
+			}
+		}
+		return nil, ErrValueNotAvailable
+	case 0x82: // 規格Version情報
+		// EDT[2]がリリース番号(ASCII)
+		if len(e.edt) >= 4 && 'A' <= e.edt[2] && e.edt[2] <= 'Z' {
+			return string(e.edt[2:3]), nil
 		}
-		slog.Info("edata", slog.String("動作状態", s))
+		return nil, ErrValueNotAvailable
 	case 0x88: // 異常発生状態
-		s := fmt.Sprintf("N/A(epc:0x%02x)", e.epc)
-		switch {
-		case e.edt[0] == 0x41:
-			s = "異常発生あり"
-		case e.edt[0] == 0x42:
-			s = "異常発生なし"
+		if len(e.edt) >= 1 {
+			switch e.edt[0] {
+			case 0x41:
+				return true, nil
+			case 0x42:
+				return false, nil
+			}
 		}
-		slog.Info("edata", slog.String("異常発生状態", s))
+		return nil, ErrValueNotAvailable
 	case 0x8a: // メーカーコード
-		s := fmt.Sprintf("N/A(epc:0x%02x)", e.epc)
 		if len(e.edt) >= 3 {
-			manufacturer := [3]byte{}
-			copy(manufacturer[:], e.edt)
-			s = hex.EncodeToString(manufacturer[:])
+			return [3]byte(e.edt[0:3]), nil
+		}
+		return nil, ErrValueNotAvailable
+	case 0x8c, 0x8d: // 商品コード, 製造番号
+		// ASCIIで12バイト 余りは空白かNULで埋められている
+		if s := strings.TrimRight(string(e.edt), " \x00"); s != "" {
+			return s, nil
+		}
+		return nil, ErrValueNotAvailable
+	case 0x97: // 現在時刻設定
+		// EDT[0] = 時, EDT[1] = 分
+		if len(e.edt) >= 2 && e.edt[0] <= 23 && e.edt[1] <= 59 {
+			return ClockTime{Hour: e.edt[0], Minute: e.edt[1]}, nil
+		}
+		return nil, ErrValueNotAvailable
+	case 0x8e, 0x98: // 製造年月日, 現在年月日設定
+		// EDT[0,1] = 年, EDT[2] = 月, EDT[3] = 日
+		if len(e.edt) >= 4 {
+			year := binary.BigEndian.Uint16(e.edt[0:2])
+			month := e.edt[2]
+			day := e.edt[3]
+			if 1 <= month && month <= 12 && 1 <= day && day <= 31 {
+				return time.Date(int(year), time.Month(month), int(day), 0, 0, 0, 0, MeterLocation), nil
+			}
 		}
-		slog.Info("edata", slog.String("製造者コード(hex)", s))
+		return nil, ErrValueNotAvailable
+	case 0x9d, 0x9e, 0x9f: // 状変アナウンスプロパティマップ, Setプロパティマップ, Getプロパティマップ
+		return decodePropertyMap(e.edt)
 	case 0xd3: // 係数
-		s := fmt.Sprintf("N/A(epc:0x%02x)", e.epc)
+		if len(e.edt) >= 4 {
+			return binary.BigEndian.Uint32(e.edt), nil
+		}
+		return nil, ErrValueNotAvailable
+	case 0xd5, 0xd6: // インスタンスリスト通知, 自ノードインスタンスリストS
 		if len(e.edt) >= 1 {
-			s = strconv.FormatInt(int64(e.edt[0]), 10)
+			var eojs [][3]byte
+			for i := 1; i+3 <= len(e.edt); i += 3 {
+				eojs = append(eojs, [3]byte(e.edt[i:i+3]))
+			}
+			return eojs, nil
 		}
-		slog.Info("edata", slog.String("係数", s))
-	case 0xd5: // インスタンスリスト通知
-		var ss []string
-		for i := 1; i < len(e.edt); i += 3 {
-			ss = append(ss, hex.EncodeToString(e.edt[i:i+3]))
-		}
-		slog.Info("edata",
-			slog.String("インスタンスリスト",
-				fmt.Sprintf("%d個 [", e.edt[0])+strings.Join(ss, ",")+"]",
-			))
+		return nil, ErrValueNotAvailable
 	case 0xd7: // 積算電力量有効桁数
-		s := fmt.Sprintf("N/A(epc:0x%02x)", e.epc)
 		if len(e.edt) >= 1 {
-			s = strconv.FormatInt(int64(e.edt[0]), 10)
+			return e.edt[0], nil
 		}
-		slog.Info("edata", slog.String("積算電力量有効桁数", s+" 桁"))
-	case 0xe0: // 積算電力量計測値(正方向計測値)
-		s := fmt.Sprintf("N/A(epc:0x%02x)", e.epc)
+		return nil, ErrValueNotAvailable
+	case 0xe0, 0xe3: // 積算電力量計測値(正方向計測値, 逆方向計測値)
 		if len(e.edt) >= 4 {
-			cwh := binary.BigEndian.Uint32(e.edt)
-			s = strconv.FormatInt(int64(cwh), 10)
+			if cwh := binary.BigEndian.Uint32(e.edt); cwh != CumulativeNotAvailable {
+				return uint64(cwh), nil
+			}
 		}
-		slog.Info("edata", slog.String("積算電力量", s))
+		return nil, ErrValueNotAvailable
 	case 0xe1: // 積算電力量単位(正方向、逆方向計測値)
-		var powersOfTen int
-		switch {
-		case e.edt[0] == 0x00:
-			powersOfTen = 0
-		case e.edt[0] == 0x01:
-			powersOfTen = -1
-		case e.edt[0] == 0x02:
-			powersOfTen = -2
-		case e.edt[0] == 0x03:
-			powersOfTen = -3
-		case e.edt[0] == 0x04:
-			powersOfTen = -4
-		case e.edt[0] == 0x0a:
-			powersOfTen = 1
-		case e.edt[0] == 0x0b:
-			powersOfTen = 2
-		case e.edt[0] == 0x0c:
-			powersOfTen = 3
-		case e.edt[0] == 0x0d:
-			powersOfTen = 4
-		default:
-			powersOfTen = 0xff
-		}
-		s := fmt.Sprintf("%f kWh", math.Pow10(powersOfTen))
-		slog.Info("edata", slog.String("積算電力量単位", s))
-	case 0xe2: // 積算電力量計測値履歴1 (正方向計測値)
-		s := fmt.Sprintf("N/A(epc:0x%02x)", e.epc)
-		if len(e.edt) >= 194 {
-			day := binary.BigEndian.Uint16(e.edt[0:2])
-			var ss [48]string
-			for i := 0; i < 48; i++ {
-				v := binary.BigEndian.Uint32(e.edt[2+4*i:])
-				if v == 0xfffffffe {
-					ss[i] = fmt.Sprintf("%8s", "N/A")
-				} else {
-					ss[i] = fmt.Sprintf("%8d", v)
-				}
+		if len(e.edt) >= 1 {
+			switch e.edt[0] {
+			case 0x00:
+				return 0, nil
+			case 0x01:
+				return -1, nil
+			case 0x02:
+				return -2, nil
+			case 0x03:
+				return -3, nil
+			case 0x04:
+				return -4, nil
+			case 0x0a:
+				return 1, nil
+			case 0x0b:
+				return 2, nil
+			case 0x0c:
+				return 3, nil
+			case 0x0d:
+				return 4, nil
 			}
-			s = fmt.Sprintf("%d日前[", day) + strings.Join(ss[:], ",") + "]"
 		}
-		slog.Info("edata", slog.String("積算電力量計測値履歴1 (正方向計測値)", s))
+		return nil, ErrValueNotAvailable
+	case 0xe2, 0xe4: // 積算電力量計測値履歴1 (正方向計測値, 逆方向計測値)
+		return decodeCumulativeHistory(e.edt)
+	case 0xe5: // 積算履歴収集日1
+		if len(e.edt) >= 1 && e.edt[0] <= MaxHistoryDaysAgo {
+			return e.edt[0], nil
+		}
+		return nil, ErrValueNotAvailable
 	case 0xe7: // 瞬時電力計測値
-		s := fmt.Sprintf("N/A(epc:0x%02x)", e.epc)
 		if len(e.edt) >= 4 {
-			iwatt := int32(binary.BigEndian.Uint32(e.edt)) // マイナスの値もある
-			s = strconv.FormatInt(int64(iwatt), 10)
+			iwatt := int32(binary.BigEndian.Uint32(e.edt)) // 符号付き 逆潮流ならマイナスの値
+			switch uint32(iwatt) {
+			case 0x7ffffffe: // 値無し
+			case 0x7fffffff, 0x80000000: // オーバーフロー, アンダーフロー
+			default:
+				return iwatt, nil
+			}
 		}
-		slog.Info("edata", slog.String("瞬時電力", s+" W"))
+		return nil, ErrValueNotAvailable
 	case 0xe8: // 瞬時電流計測値
-		s := fmt.Sprintf("N/A(epc:0x%02x)", e.epc)
 		if len(e.edt) >= 4 {
-			r := int16(binary.BigEndian.Uint16(e.edt[0:2])) // マイナスの値もある
-			t := int16(binary.BigEndian.Uint16(e.edt[2:4])) // マイナスの値もある
-
-			if t == 0x7ffe { // 単相2線式
-				s = fmt.Sprintf("(1φ2W) %3d.%01d", r/10, r%10)
-			} else {
-				s = fmt.Sprintf("(1φ3W) R:%3d.%01d, T:%3d.%01d", r/10, r%10, t/10, t%10)
+			current := InstantCurrent{
+				R: int16(binary.BigEndian.Uint16(e.edt[0:2])), // マイナスの値もある
+				T: int16(binary.BigEndian.Uint16(e.edt[2:4])), // マイナスの値もある
+			}
+			if current.R != 0x7ffe {
+				return current, nil
 			}
 		}
-		slog.Info("edata", slog.String("瞬時電流", s))
+		return nil, ErrValueNotAvailable
+	case 0xec: // 積算電力量計測値履歴2(正方向、逆方向計測値)
+		return decodeCumulativeHistory2(e.edt)
+	case 0xed: // 積算履歴収集日2
+		if t, ok := decodeDateTimeMinute(e.edt); ok && len(e.edt) >= 7 && 1 <= e.edt[6] && e.edt[6] <= MaxHistory2Slots {
+			return HistoryCollectionTime2{Time: t, Slots: e.edt[6]}, nil
+		}
+		return nil, ErrValueNotAvailable
 	case 0xea: // 定時積算電力量計測値(正方向計測値)
-		s := "N/A"
 		if len(e.edt) >= 11 {
 			year := binary.BigEndian.Uint16(e.edt[0:2])
 			month := e.edt[2]
@@ -241,14 +739,168 @@ func (e *EchonetliteEdata) Show() {
 			minute := e.edt[5]
 			second := e.edt[6]
 			cwh := binary.BigEndian.Uint32(e.edt[7:])
-			s = fmt.Sprintf("%04d/%02d/%02d %02d:%02d:%02d (%8d)", year, month, day, hour, minute, second, cwh)
+			if cwh != CumulativeNotAvailable {
+				return FixedTimeCumulative{
+					Time:  time.Date(int(year), time.Month(month), int(day), int(hour), int(minute), int(second), 0, MeterLocation),
+					Value: uint64(cwh),
+				}, nil
+			}
 		}
-		slog.Info("edata", slog.String("定時積算電力量計測値(正方向計測値)", s))
+		return nil, ErrValueNotAvailable
 	default:
+		return nil, fmt.Errorf("epc:0x%02x %w", e.epc, ErrUnknownEpc)
+	}
+}
+
+// EDATA値を表示する
+func (e *EchonetliteEdata) Show() {
+	v, err := e.Value()
+	name := EpcName(e.epc)
+	if errors.Is(err, ErrUnknownEpc) {
 		slog.Debug("edata",
+			slog.String("epc", name),
 			slog.String("epc(hex)", strconv.FormatInt(int64(e.epc), 16)),
 			slog.String("pdc(hex)", strconv.FormatInt(int64(e.pdc), 16)),
 			slog.String("edt(hex)", hex.EncodeToString(e.edt)),
 		)
+		return
+	}
+	s := fmt.Sprintf("N/A(epc:0x%02x)", e.epc)
+	switch e.epc {
+	case 0x80: // 動作状態
+		if err == nil {
+			s = "未動作"
+			if v.(bool) {
+				s = "動作中"
+			}
+		}
+	case 0x82: // 規格Version情報
+		if err == nil {
+			s = "Release " + v.(string)
+		}
+	case 0x88: // 異常発生状態
+		if err == nil {
+			s = "異常発生なし"
+			if v.(bool) {
+				s = "異常発生あり"
+			}
+		}
+	case 0x8a: // メーカーコード
+		if err == nil {
+			s = ManufacturerName(v.([3]byte))
+		}
+	case 0x8c: // 商品コード
+		if err == nil {
+			s = v.(string)
+		}
+	case 0x8d: // 製造番号
+		if err == nil {
+			s = v.(string)
+		}
+	case 0x8e: // 製造年月日
+		if err == nil {
+			s = v.(time.Time).Format("2006/01/02")
+		}
+	case 0x97: // 現在時刻設定
+		if err == nil {
+			clock := v.(ClockTime)
+			s = fmt.Sprintf("%02d:%02d", clock.Hour, clock.Minute)
+		}
+	case 0x98: // 現在年月日設定
+		if err == nil {
+			s = v.(time.Time).Format("2006/01/02")
+		}
+	case 0x9d: // 状変アナウンスプロパティマップ
+		if err == nil {
+			s = v.(PropertyMap).String()
+		}
+	case 0x9e: // Setプロパティマップ
+		if err == nil {
+			s = v.(PropertyMap).String()
+		}
+	case 0x9f: // Getプロパティマップ
+		if err == nil {
+			s = v.(PropertyMap).String()
+		}
+	case 0xd3: // 係数
+		if err == nil {
+			s = strconv.FormatUint(uint64(v.(uint32)), 10)
+		}
+	case 0xd5: // インスタンスリスト通知
+		if err == nil {
+			var ss []string
+			for _, eoj := range v.([][3]byte) {
+				ss = append(ss, hex.EncodeToString(eoj[:]))
+			}
+			s = fmt.Sprintf("%d個 [", e.edt[0]) + strings.Join(ss, ",") + "]"
+		}
+	case 0xd6: // 自ノードインスタンスリストS
+		if err == nil {
+			var ss []string
+			for _, eoj := range v.([][3]byte) {
+				ss = append(ss, hex.EncodeToString(eoj[:]))
+			}
+			s = fmt.Sprintf("%d個 [", e.edt[0]) + strings.Join(ss, ",") + "]"
+		}
+	case 0xd7: // 積算電力量有効桁数
+		if err == nil {
+			s = strconv.FormatInt(int64(v.(uint8)), 10) + " 桁"
+		}
+	case 0xe0: // 積算電力量計測値(正方向計測値)
+		if err == nil {
+			s = strconv.FormatUint(v.(uint64), 10)
+		}
+	case 0xe3: // 積算電力量計測値(逆方向計測値)
+		if err == nil {
+			s = strconv.FormatUint(v.(uint64), 10)
+		}
+	case 0xe4: // 積算電力量計測値履歴1 (逆方向計測値)
+		if err == nil {
+			s = v.(CumulativeHistory).String()
+		}
+	case 0xe5: // 積算履歴収集日1
+		if err == nil {
+			if days := v.(uint8); days == 0 {
+				s = "今日"
+			} else {
+				s = fmt.Sprintf("%d日前", days)
+			}
+		}
+	case 0xe1: // 積算電力量単位(正方向、逆方向計測値)
+		if err == nil {
+			s = fmt.Sprintf("%f kWh", math.Pow10(v.(int)))
+		}
+	case 0xe2: // 積算電力量計測値履歴1 (正方向計測値)
+		if err == nil {
+			s = v.(CumulativeHistory).String()
+		}
+	case 0xe7: // 瞬時電力計測値
+		if err == nil {
+			s = strconv.FormatInt(int64(v.(int32)), 10) + " W"
+		}
+	case 0xe8: // 瞬時電流計測値
+		if err == nil {
+			current := v.(InstantCurrent)
+			if t, ok := current.TAmpere(); ok {
+				s = fmt.Sprintf("(%s) R:%5.1f, T:%5.1f", current.Wiring(), current.RAmpere(), t)
+			} else {
+				s = fmt.Sprintf("(%s) %5.1f", current.Wiring(), current.RAmpere())
+			}
+		}
+	case 0xea: // 定時積算電力量計測値(正方向計測値)
+		if err == nil {
+			fixed := v.(FixedTimeCumulative)
+			s = fmt.Sprintf("%s (%8d)", fixed.Time.Format("2006/01/02 15:04:05"), fixed.Value)
+		}
+	case 0xec: // 積算電力量計測値履歴2(正方向、逆方向計測値)
+		if err == nil {
+			s = v.(CumulativeHistory2).String()
+		}
+	case 0xed: // 積算履歴収集日2
+		if err == nil {
+			h := v.(HistoryCollectionTime2)
+			s = fmt.Sprintf("%s %dコマ", h.Time.Format("2006/01/02 15:04"), h.Slots)
+		}
 	}
+	slog.Info("edata", slog.String(name, s))
 }
@@ -0,0 +1,333 @@
+// BP35Cx-J11を使ってスマートメータから電力消費量などを得る
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 Akihiro Yamamoto <github.com/ak1211>
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"math/rand/v2"
+	"strings"
+	"testing"
+)
+
+// 16進数文字列をバイト列にする(空白は無視する)
+func mustDecodeHex(t testing.TB, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(string(bytes.Join(bytes.Fields([]byte(s)), nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// 瞬時電力計測値(0xe7)のGet_res
+const getResInstantWatt = "1081 0001 028801 05ff01 72 01 e7 04 00000190"
+
+func TestParseEchonetliteFrameTruncated(t *testing.T) {
+	// PDCが0xfe,0xffのEDTを持つプロパティ
+	long := func(pdc byte, edtBytes int) []byte {
+		b := mustDecodeHex(t, "1081 0001 028801 05ff01 72 01 e2")
+		b = append(b, pdc)
+		return append(b, make([]byte, edtBytes)...)
+	}
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"ヘッダ部のみ", mustDecodeHex(t, "1081 0001 028801 05ff01 72 01")},
+		{"EPCのみ", mustDecodeHex(t, "1081 0001 028801 05ff01 72 01 e7")},
+		{"EDTが足りない", mustDecodeHex(t, "1081 0001 028801 05ff01 72 01 e7 04 0000")},
+		{"OPCの数だけプロパティが無い", mustDecodeHex(t, "1081 0001 028801 05ff01 72 02 e7 04 00000190")},
+		{"PDC=0xffでEDTが足りない", long(0xff, 0xfe)},
+		{"PDC=0xfeでEDTが足りない", long(0xfe, 0xfd)},
+		{"SetGetのGet側のOPCが無い", mustDecodeHex(t, "1081 0001 028801 05ff01 7e 01 e5 00")},
+		{"SetGetのGet側のEDTが足りない", mustDecodeHex(t, "1081 0001 028801 05ff01 7e 01 e5 00 01 e2 c2 0000")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frame, err := ParseEchonetliteFrame(tt.data)
+			if err == nil {
+				t.Errorf("ParseEchonetliteFrame(%x) = %+v, want error", tt.data, frame)
+			}
+		})
+	}
+}
+
+func TestParseEchonetliteFrameLongPdc(t *testing.T) {
+	// PDCが0xfe,0xffでもEDTが揃っていれば解釈できる
+	for _, pdc := range []byte{0xfe, 0xff} {
+		data := mustDecodeHex(t, "1081 0001 028801 05ff01 72 01 e2")
+		data = append(data, pdc)
+		data = append(data, make([]byte, pdc)...)
+		frame, err := ParseEchonetliteFrame(data)
+		if err != nil {
+			t.Fatalf("pdc=0x%02x: %v", pdc, err)
+		}
+		if len(frame.edata) != 1 || len(frame.edata[0].edt) != int(pdc) {
+			t.Errorf("pdc=0x%02x: edata = %+v", pdc, frame.edata)
+		}
+	}
+}
+
+func TestParseEchonetliteFrame(t *testing.T) {
+	frame, err := ParseEchonetliteFrame(mustDecodeHex(t, getResInstantWatt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.tid != 1 || frame.seoj != EojSmartmeter || frame.deoj != EojHomeController || frame.esv != 0x72 {
+		t.Errorf("header = %+v", frame)
+	}
+	if len(frame.edata) != 1 || frame.edata[0].epc != 0xe7 || !bytes.Equal(frame.edata[0].edt, []byte{0, 0, 1, 0x90}) {
+		t.Errorf("edata = %+v", frame.edata)
+	}
+}
+
+func TestInstantWattValue(t *testing.T) {
+	// 瞬時電力計測値(0xe7)は符号付きで、逆潮流(売電)なら負の値になる
+	tests := []struct {
+		name    string
+		edt     string
+		want    int32
+		wantErr error
+	}{
+		{"順潮流", "00000190", 400, nil},
+		{"逆潮流", "fffffed4", -300, nil},
+		{"最上位ビットだけ", "80000001", -2147483647, nil},
+		{"最大値", "7ffffffd", 2147483645, nil},
+		{"値無し", "7ffffffe", 0, ErrValueNotAvailable},
+		{"オーバーフロー", "7fffffff", 0, ErrValueNotAvailable},
+		{"アンダーフロー", "80000000", 0, ErrValueNotAvailable},
+		{"EDTが足りない", "fffffe", 0, ErrValueNotAvailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			edt := mustDecodeHex(t, tt.edt)
+			v, err := (&EchonetliteEdata{epc: 0xe7, pdc: byte(len(edt)), edt: edt}).Value()
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("Value() = %v, %v, want %v", v, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || v != tt.want {
+				t.Errorf("Value() = %v, %v, want %d", v, err, tt.want)
+			}
+		})
+	}
+}
+
+// 定期的な読み取りで送るGet要求(積算電力量計測値, 瞬時電力計測値, 瞬時電流計測値)
+func pollingGetFrame() EchonetliteFrame {
+	return EchonetliteFrame{
+		ehd:   0x1081,
+		tid:   1,
+		seoj:  EojHomeController,
+		deoj:  EojSmartmeter,
+		esv:   0x62, // Get要求
+		edata: []EchonetliteEdata{{epc: 0xe0}, {epc: 0xe7}, {epc: 0xe8}},
+	}
+}
+
+func TestAppendEncode(t *testing.T) {
+	frame := pollingGetFrame()
+	want := mustDecodeHex(t, "1081 0001 05ff01 028801 62 03 e0 00 e7 00 e8 00")
+	if got := frame.Encode(); !bytes.Equal(got, want) {
+		t.Errorf("Encode() = %x, want %x", got, want)
+	}
+	// dstの中身は残して後ろに追加する
+	prefix := []byte{0xaa, 0xbb}
+	if got := frame.AppendEncode(prefix); !bytes.Equal(got, append(prefix, want...)) {
+		t.Errorf("AppendEncode() = %x, want %x", got, append(prefix, want...))
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	frame := pollingGetFrame()
+	b.ReportAllocs()
+	for b.Loop() {
+		_ = frame.Encode()
+	}
+}
+
+func BenchmarkAppendEncode(b *testing.B) {
+	frame := pollingGetFrame()
+	buf := make([]byte, 0, 64)
+	b.ReportAllocs()
+	for b.Loop() {
+		buf = frame.AppendEncode(buf[:0])
+	}
+}
+
+func TestEncodeOpcMismatch(t *testing.T) {
+	// opcがedataの数と食い違っていても、edataの数をOPCにした電文を送る
+	tests := []struct {
+		name  string
+		frame EchonetliteFrame
+		want  string
+	}{
+		{
+			"opcが多い",
+			EchonetliteFrame{ehd: 0x1081, tid: 1, seoj: EojHomeController, deoj: EojSmartmeter, esv: 0x62, opc: 5,
+				edata: []EchonetliteEdata{{epc: 0xe0}, {epc: 0xe7}}},
+			"1081 0001 05ff01 028801 62 02 e0 00 e7 00",
+		},
+		{
+			"opcが少ない",
+			EchonetliteFrame{ehd: 0x1081, tid: 1, seoj: EojHomeController, deoj: EojSmartmeter, esv: 0x62, opc: 0,
+				edata: []EchonetliteEdata{{epc: 0xe7}}},
+			"1081 0001 05ff01 028801 62 01 e7 00",
+		},
+		{
+			"SetGetのGet側",
+			EchonetliteFrame{ehd: 0x1081, tid: 1, seoj: EojHomeController, deoj: EojSmartmeter, esv: 0x6e, opc: 3,
+				edata:    []EchonetliteEdata{{epc: 0xe5, pdc: 1, edt: []byte{0x00}}},
+				getEdata: []EchonetliteEdata{{epc: 0xe2}}},
+			"1081 0001 05ff01 028801 6e 01 e5 01 00 01 e2 00",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.frame.Encode()
+			if want := mustDecodeHex(t, tt.want); !bytes.Equal(got, want) {
+				t.Errorf("Encode() = %x, want %x", got, want)
+			}
+			// 送った電文はそのまま解釈できる
+			if _, err := ParseEchonetliteFrame(got); err != nil {
+				t.Errorf("ParseEchonetliteFrame(%x): %v", got, err)
+			}
+		})
+	}
+}
+
+func TestParseEchonetliteFrameRandomShort(t *testing.T) {
+	// 乱数で作った短いバイト列をいくら与えてもパニックせずにエラーを返す
+	// 失敗を再現できるように種は固定する
+	rng := rand.New(rand.NewPCG(1, 2))
+	header := mustDecodeHex(t, "1081 0001 028801 05ff01")
+	esvs := []byte{0x62, 0x72, 0x73, 0x7e, 0x52, 0x5e}
+	for i := 0; i < 100000; i++ {
+		data := bytes.Clone(header)
+		data = append(data, esvs[rng.IntN(len(esvs))], byte(rng.IntN(256)))
+		props := make([]byte, rng.IntN(32))
+		for j := range props {
+			props[j] = byte(rng.IntN(256))
+		}
+		data = append(data, props...)
+		frame, err := ParseEchonetliteFrame(data)
+		if err != nil {
+			continue
+		}
+		// 解釈できた電文のプロパティ値を取り出してもパニックしない
+		for _, edata := range append(frame.edata, frame.getEdata...) {
+			edata.Value()
+		}
+	}
+	// 正しい電文をどこで切り詰めてもパニックせずにエラーを返す
+	valid := mustDecodeHex(t, "1081 0001 028801 05ff01 72 03 e0 04 0001e240 e7 04 000001f4 e8 04 00320014")
+	for n := range len(valid) {
+		if frame, err := ParseEchonetliteFrame(valid[:n]); err == nil {
+			t.Errorf("ParseEchonetliteFrame(%x) = %+v, want error", valid[:n], frame)
+		}
+	}
+	// OPCの数だけプロパティが無ければどこで足りなくなったかを言う
+	_, err := ParseEchonetliteFrame(mustDecodeHex(t, "1081 0001 028801 05ff01 72 03 e0 04 0001e240"))
+	if err == nil || !strings.Contains(err.Error(), "opc=3 but ran out of bytes at edata 1") {
+		t.Errorf("err = %v", err)
+	}
+}
+
+// 任意のバイト列を与えてもパニックせずにエラーを返す
+func FuzzParseEchonetliteFrame(f *testing.F) {
+	f.Add(mustDecodeHex(f, getResInstantWatt))
+	f.Add(mustDecodeHex(f, "1081 0001 028801 05ff01 7e 01 e5 01 00 01 e2 00"))
+	f.Add(mustDecodeHex(f, "1081 0000 0ef001 0ef001 73 01 d5 04 01 028801"))
+	f.Add(mustDecodeHex(f, "1081 0001 028801 05ff01 72 01 ea 0b 07e9 01 02 0f 1e 00 0001e23a"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		frame, err := ParseEchonetliteFrame(data)
+		if err != nil {
+			return
+		}
+		// 解釈できた電文のプロパティ値を取り出してもパニックしない
+		for _, edata := range append(frame.edata, frame.getEdata...) {
+			edata.Value()
+		}
+		// 解釈できた電文を符号化し直すと元の電文の先頭と同じになる
+		if encoded := frame.Encode(); !bytes.HasPrefix(data, encoded) {
+			t.Errorf("Encode() = %x, want prefix of %x", encoded, data)
+		}
+	})
+}
+
+func FuzzParseEdata(f *testing.F) {
+	f.Add(mustDecodeHex(f, "e7 04 00000190"), byte(1))
+	f.Add(mustDecodeHex(f, "e0 00 e7 00 e8 00"), byte(3))
+	f.Add(append([]byte{0xe2, 0xff}, make([]byte, 0xff)...), byte(1))
+	f.Fuzz(func(t *testing.T, props []byte, opc byte) {
+		edata, rest, err := parseEdata(props, opc)
+		if err != nil {
+			return
+		}
+		if len(edata) != int(opc) {
+			t.Errorf("len(edata) = %d, want %d", len(edata), opc)
+		}
+		// 読んだプロパティと残りのバイト列で元のバイト列になる
+		n := len(props) - len(rest)
+		var encoded []byte
+		for i := range edata {
+			if int(edata[i].pdc) != len(edata[i].edt) {
+				t.Errorf("edata %d: pdc=%d but len(edt)=%d", i, edata[i].pdc, len(edata[i].edt))
+			}
+			encoded = edata[i].AppendEncode(encoded)
+		}
+		if !bytes.Equal(encoded, props[:n]) {
+			t.Errorf("edata = %x, want %x", encoded, props[:n])
+		}
+	})
+}
+
+func TestCumulativeScaleDelta(t *testing.T) {
+	tests := []struct {
+		name      string
+		digits    uint8
+		prev, cur uint64
+		want      uint64
+		ok        bool
+	}{
+		{"増えた", 6, 123450, 123461, 11, true},
+		{"変わらない", 6, 123450, 123450, 0, true},
+		{"一周した", 6, 999990, 5, 15, true},
+		{"最大値から0に戻った", 6, 999999, 0, 1, true},
+		{"8桁で一周した", 8, 99999999, 1, 2, true},
+		{"uint32を超える9桁で一周した", 9, 999999999, 4294967, 4294968, true},
+		{"19桁で一周した", 19, 9999999999999999999, 0, 1, true},
+		{"有効桁数が分からない", 0, 999990, 5, 0, false},
+		{"有効桁数が大きすぎる", 20, 999990, 5, 0, false},
+		{"前回が有効桁数を超えている", 6, 1000000, 5, 0, false},
+		{"今回が有効桁数を超えている", 6, 999990, 1000000, 0, false},
+		{"有効桁数が分からなければ増えた分だけ", 0, 123450, 1234567890, 1234444440, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scale := CumulativeScale{Coefficient: 1, PowersOfTen: -1, Digits: tt.digits}
+			got, ok := scale.Delta(tt.prev, tt.cur)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("Delta(%d, %d) = %d, %v, want %d, %v", tt.prev, tt.cur, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestCumulativeValue(t *testing.T) {
+	// 積算電力量計測値は4バイトの最大値まで桁あふれせずに換算する
+	edata := EchonetliteEdata{epc: 0xe0, pdc: 4, edt: []byte{0x05, 0xf5, 0xe0, 0xff}}
+	v, err := edata.Value()
+	if err != nil || v != uint64(99999999) {
+		t.Fatalf("Value() = %v, %v, want 99999999", v, err)
+	}
+	scale := CumulativeScale{Coefficient: 1000, PowersOfTen: 1, Digits: 8}
+	if got, want := scale.KWh(v.(uint64)), 999999990000.0; got != want {
+		t.Errorf("KWh() = %v, want %v", got, want)
+	}
+}
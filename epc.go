@@ -0,0 +1,49 @@
+// BP35Cx-J11を使ってスマートメータから電力消費量などを得る
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 Akihiro Yamamoto <github.com/ak1211>
+package main
+
+import "fmt"
+
+// 低圧スマート電力量メータクラスのEPCの表示名
+// インスタンスリストなどノードプロファイルのものも含む
+var epcRegistry = map[byte]string{
+	0x80: "動作状態",
+	0x81: "設置場所",
+	0x82: "規格Version情報",
+	0x88: "異常発生状態",
+	0x8a: "製造者コード",
+	0x8c: "商品コード",
+	0x8d: "製造番号",
+	0x8e: "製造年月日",
+	0x97: "現在時刻設定",
+	0x98: "現在年月日設定",
+	0x9d: "状変アナウンスプロパティマップ",
+	0x9e: "Setプロパティマップ",
+	0x9f: "Getプロパティマップ",
+	0xd3: "係数",
+	0xd5: "インスタンスリスト",
+	0xd6: "自ノードインスタンスリストS",
+	0xd7: "積算電力量有効桁数",
+	0xe0: "積算電力量",
+	0xe1: "積算電力量単位",
+	0xe2: "積算電力量計測値履歴1 (正方向計測値)",
+	0xe3: "積算電力量(逆方向)",
+	0xe4: "積算電力量計測値履歴1 (逆方向計測値)",
+	0xe5: "積算履歴収集日1",
+	0xe7: "瞬時電力",
+	0xe8: "瞬時電流",
+	0xea: "定時積算電力量計測値(正方向計測値)",
+	0xeb: "定時積算電力量計測値(逆方向計測値)",
+	0xec: "積算電力量計測値履歴2(正方向、逆方向計測値)",
+	0xed: "積算履歴収集日2",
+}
+
+// EPCの表示名を返す
+// 表に無ければ"(unknown EPC 0xNN)"にする
+func EpcName(epc byte) string {
+	if name, ok := epcRegistry[epc]; ok {
+		return name
+	}
+	return fmt.Sprintf("(unknown EPC 0x%02x)", epc)
+}
@@ -4,19 +4,24 @@
 package main
 
 import (
+	"context"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 	"log/slog"
 	"net/netip"
+	"sync"
 )
 
 // チェックサム計算
+// 仕様書の通り各バイトを単純に加算した値の下位2バイト(1の補数和ではないので桁上がりは捨てる)
+// 例: ハードウェアリセットコマンドのヘッダ部 d0 ea 83 fc 00 d9 00 04 は 0x0416
 func CalcChecksum(data []byte) uint16 {
 	var acc uint16
 	for _, v := range data {
-		acc += uint16(v)
-		acc &= 0xffff
+		acc += uint16(v) // uint16の桁あふれで下位2バイトだけが残る
 	}
 	return acc
 }
@@ -71,188 +76,518 @@ type BeaconResponse struct {
 type RouteBId [32]byte
 type RouteBPassword [12]byte
 
+// ルートB認証IDを検査する
+// 認証IDは英大文字の16進数32文字
+func ParseRouteBId(s string) (RouteBId, error) {
+	if len(s) != len(RouteBId{}) {
+		return RouteBId{}, fmt.Errorf("ルートＢＩＤは%d文字です", len(RouteBId{}))
+	}
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'A' <= c && c <= 'F') {
+			return RouteBId{}, fmt.Errorf("ルートＢＩＤに使えない文字 %q があります(0～9,A～F)", c)
+		}
+	}
+	return RouteBId([]byte(s)), nil
+}
+
+// ルートBパスワードを検査する
+// パスワードは英数字12文字
+func ParseRouteBPassword(s string) (RouteBPassword, error) {
+	if len(s) != len(RouteBPassword{}) {
+		return RouteBPassword{}, fmt.Errorf("ルートＢパスワードは%d文字です", len(RouteBPassword{}))
+	}
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z') {
+			return RouteBPassword{}, fmt.Errorf("ルートＢパスワードに使えない文字 %q があります(英数字)", c)
+		}
+	}
+	return RouteBPassword([]byte(s)), nil
+}
+
 // ユニークコード(要求コマンド)
 const UniqueCodeRequestCommand uint32 = 0xd0ea83fc
 
 // ユニークコード(応答/通知コマンド)
 const UniqueCodeResponseCommand uint32 = 0xd0f9ee5d
 
-// ファームウェアバージョン取得コマンド
-func CommandGetFirmwareVersion() J11Datagram {
-	return J11Datagram{
+// 要求コマンドを作る
+// メッセージ長とチェックサムはここで計算する
+func newCommand(commandCode uint16, data []byte) J11Datagram {
+	command := J11Datagram{
 		Header: J11DatagramHeader{
-			UniqueCode:     UniqueCodeRequestCommand,
-			CommandCode:    0x006b,
-			MessageLen:     0x0004,
-			HeaderChecksum: 0x03a8,
-			DataChecksum:   0x0000,
+			UniqueCode:  UniqueCodeRequestCommand,
+			CommandCode: commandCode,
+			MessageLen:  4 + uint16(len(data)), // ヘッダ部チェックサム,データ部チェックサム(4バイト)+データ部
 		},
-		Data: []byte{},
+		Data: data,
 	}
+	command.Header.HeaderChecksum = command.Header.CalcHeaderChecksum()
+	command.Header.DataChecksum = CalcChecksum(command.Data)
+	return command
+}
+
+// ファームウェアバージョン取得コマンド
+func CommandGetFirmwareVersion() J11Datagram {
+	return newCommand(0x006b, []byte{})
+}
+
+// ファームウェアバージョン取得応答(0x206b)を解釈する
+func ParseResponseFirmwareVersion(r J11Datagram) (string, error) {
+	// Data[0] = 結果コード
+	// Data[1,2] = ファームウェアID
+	// Data[3] = メジャーバージョン
+	// Data[4] = マイナーバージョン
+	// Data[5,6,7,8] = リビジョン
+	if r.Header.CommandCode != 0x206b {
+		return "", fmt.Errorf("command code:0x%04x is not a firmware version response", r.Header.CommandCode)
+	}
+	if len(r.Data) < 9 {
+		return "", fmt.Errorf("firmware version response too short(%d)", len(r.Data))
+	}
+	firmwareId := binary.BigEndian.Uint16(r.Data[1:3])
+	major := r.Data[3]
+	minor := r.Data[4]
+	revision := binary.BigEndian.Uint32(r.Data[5:9])
+	return fmt.Sprintf("%04x ver.%d.%d rev.%d", firmwareId, major, minor, revision), nil
 }
 
 // ハードウェアリセットコマンド
 func CommandHardwareReset() J11Datagram {
-	return J11Datagram{
-		Header: J11DatagramHeader{
-			UniqueCode:     UniqueCodeRequestCommand,
-			CommandCode:    0x00d9,
-			MessageLen:     0x0004,
-			HeaderChecksum: 0x0000,
-			DataChecksum:   0x0000,
-		},
-		Data: []byte{},
-	}
+	return newCommand(0x00d9, []byte{})
 }
 
+// 初期設定要求コマンドのチャネル以外の設定
+type InitialSetupOptions struct {
+	// 動作モード(0x05: Bルート動作モード)
+	Mode uint8
+	// HAN Sleep機能(false: 無効, true: 有効)
+	HanSleep bool
+	// 送信電力(0x00: 20mW, 0x01: 10mW, 0x02: 1mW)
+	TxPower uint8
+}
+
+// Bルートでスマートメーターに接続するときの初期設定
+var DefaultInitialSetupOptions = InitialSetupOptions{Mode: 0x05, HanSleep: false, TxPower: 0x00}
+
 // 初期設定要求コマンド
-func CommandInitialSetup(channel uint8) J11Datagram {
-	return J11Datagram{
-		Header: J11DatagramHeader{
-			UniqueCode:     UniqueCodeRequestCommand,
-			CommandCode:    0x005f,
-			MessageLen:     0x0008,
-			HeaderChecksum: 0x0000,
-			DataChecksum:   0x0000,
-		},
-		Data: []byte{0x05, 0x00, channel, 0x00},
+//
+//	Data[0] = 動作モード
+//	Data[1] = HAN Sleep機能
+//	Data[2] = チャネル(4～17)
+//	Data[3] = 送信電力
+func CommandInitialSetup(channel uint8, opts InitialSetupOptions) J11Datagram {
+	var hanSleep uint8
+	if opts.HanSleep {
+		hanSleep = 0x01
 	}
+	return newCommand(0x005f, []byte{opts.Mode, hanSleep, channel, opts.TxPower})
 }
 
 // PANA認証情報設定コマンド
 func CommandSetPanaAuthInfo(routeBId RouteBId, routeBPassword RouteBPassword) J11Datagram {
 	data := routeBId[:]                       // 認証ID(32バイト)
 	data = append(data, routeBPassword[:]...) // 認証パスワード(12バイト)
-	command := J11Datagram{
-		Header: J11DatagramHeader{
-			UniqueCode:     UniqueCodeRequestCommand,
-			CommandCode:    0x0054,
-			MessageLen:     0x0030,
-			HeaderChecksum: 0x03bd,
-			DataChecksum:   0,
-		},
-		Data: data,
-	}
-	command.Header.DataChecksum = CalcChecksum(command.Data)
-	return command
+	return newCommand(0x0054, data)
 }
 
 // Bルート動作開始要求コマンド
 func CommandBRouteStart() J11Datagram {
-	return J11Datagram{
-		Header: J11DatagramHeader{
-			UniqueCode:     UniqueCodeRequestCommand,
-			CommandCode:    0x0053,
-			MessageLen:     0x0004,
-			HeaderChecksum: 0x0390,
-			DataChecksum:   0x0000,
-		},
-		Data: []byte{},
-	}
+	return newCommand(0x0053, []byte{})
 }
 
 // Bルート動作終了要求コマンド
 func CommandBRouteTerminate() J11Datagram {
-	return J11Datagram{
-		Header: J11DatagramHeader{
-			UniqueCode:     UniqueCodeRequestCommand,
-			CommandCode:    0x0053,
-			MessageLen:     0x0004,
-			HeaderChecksum: 0x0395,
-			DataChecksum:   0x0000,
-		},
-		Data: []byte{},
-	}
+	return newCommand(0x0058, []byte{})
 }
 
 // アクティブスキャン実行要求コマンド
-func CommandActivescan(scanDuration uint8, routeBId RouteBId) J11Datagram {
-	data := []byte{scanDuration}                           // スキャン時間(1バイト)
-	data = append(data, []byte{0x00, 0x03, 0xff, 0xf0}...) // スキャンチャネル4,5,6指定(4バイト)
-	data = append(data, 0x01)                              // ID設定(1バイト)
-	data = append(data, routeBId[len(routeBId)-8:]...)     // Ｂルート認証IDの最後8文字(8バイト)
-	command := J11Datagram{
-		Header: J11DatagramHeader{
-			UniqueCode:     UniqueCodeRequestCommand,
-			CommandCode:    0x0051,
-			MessageLen:     0x0012,
-			HeaderChecksum: 0x039c,
-			DataChecksum:   0,
-		},
-		Data: data,
+func CommandActivescan(scanDuration uint8, channelMask uint32, routeBId RouteBId) J11Datagram {
+	data := []byte{scanDuration}                            // スキャン時間(1バイト)
+	data = binary.BigEndian.AppendUint32(data, channelMask) // スキャンチャネル指定(4バイト)
+	data = append(data, 0x01)                               // ID設定(1バイト)
+	data = append(data, routeBId[len(routeBId)-8:]...)      // Ｂルート認証IDの最後8文字(8バイト)
+	return newCommand(0x0051, data)
+}
+
+// スキャンチャネル指定の既定値(チャネル4～17)
+const DefaultScanChannelMask uint32 = 0x0003fff0
+
+// スキャンするチャネル番号(4～17)からスキャンチャネル指定を作る
+// ビットNがチャネルNに対応する
+func ScanChannelMask(channels []uint8) (uint32, error) {
+	var mask uint32
+	for _, ch := range channels {
+		if ch < 4 || 17 < ch {
+			return 0, fmt.Errorf("channel %d is out of range(4～17)", ch)
+		}
+		mask |= 1 << ch
 	}
-	command.Header.DataChecksum = CalcChecksum(command.Data)
-	return command
+	if mask == 0 {
+		return 0, errors.New("no channel specified")
+	}
+	return mask, nil
 }
 
+// ECHONET Liteの既定のUDPポート番号
+const EchonetLitePort uint16 = 0x0e1a
+
 // UDPポートオープン要求コマンド
 func CommandUdpPortOpen(port uint16) J11Datagram {
-	data := make([]byte, 2)
-	binary.BigEndian.PutUint16(data, port)
-	command := J11Datagram{
-		Header: J11DatagramHeader{
-			UniqueCode:     UniqueCodeRequestCommand,
-			CommandCode:    0x0005,
-			MessageLen:     0x0006,
-			HeaderChecksum: 0x0344,
-			DataChecksum:   0,
-		},
-		Data: data,
-	}
-	command.Header.DataChecksum = CalcChecksum(command.Data)
-	return command
+	data := binary.BigEndian.AppendUint16([]byte{}, port) // UDPポート番号(2バイト)
+	return newCommand(0x0005, data)
+}
+
+// UDPポートクローズ要求コマンド
+func CommandUdpPortClose(port uint16) J11Datagram {
+	data := binary.BigEndian.AppendUint16([]byte{}, port) // UDPポート番号(2バイト)
+	return newCommand(0x0006, data)
 }
 
 // BルートPANA開始要求コマンド
 func CommandBRouteStartPana() J11Datagram {
-	return J11Datagram{
-		Header: J11DatagramHeader{
-			UniqueCode:     UniqueCodeRequestCommand,
-			CommandCode:    0x0056,
-			MessageLen:     0x0004,
-			HeaderChecksum: 0x0393,
-			DataChecksum:   0x0000,
-		},
-		Data: []byte{},
-	}
+	return newCommand(0x0056, []byte{})
 }
 
 // BルートPANA終了要求コマンド
 func CommandBRouteTerminatePana() J11Datagram {
-	return J11Datagram{
-		Header: J11DatagramHeader{
-			UniqueCode:     UniqueCodeRequestCommand,
-			CommandCode:    0x0057,
-			MessageLen:     0x0004,
-			HeaderChecksum: 0x0394,
-			DataChecksum:   0x0000,
-		},
-		Data: []byte{},
+	return newCommand(0x0057, []byte{})
+}
+
+// 要求コマンドが拒否された(結果コードが0x01以外)ことを示すエラー
+// errors.Isでどの段階で拒否されたか判別できる
+var (
+	ErrInitialSetupRejected = errors.New("initial setup rejected")
+	ErrPanaAuthInfoRejected = errors.New("PANA auth info rejected")
+	ErrBRouteStartRejected  = errors.New("B-route start rejected")
+	ErrUdpPortOpenRejected  = errors.New("UDP port open rejected")
+	ErrPanaStartRejected    = errors.New("PANA start rejected")
+	ErrActiveScanRejected   = errors.New("active scan rejected")
+	ErrCommandRejected      = errors.New("command rejected") // 上記以外
+)
+
+// 要求コマンドの応答が失敗を示した
+type CommandError struct {
+	Name        string // 要求コマンド名
+	CommandCode uint16 // 応答コマンドコード
+	ResultCode  uint8  // 結果コード
+}
+
+// 応答からエラーを作る
+func NewCommandError(name string, r J11Datagram) *CommandError {
+	e := &CommandError{Name: name, CommandCode: r.Header.CommandCode}
+	if len(r.Data) >= 1 {
+		e.ResultCode = r.Data[0]
+	}
+	return e
+}
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("%s: command code:0x%04x, result code:0x%02x", e.Name, e.CommandCode, e.ResultCode)
+}
+
+// 応答コマンドコードから拒否された段階を返す
+func (e *CommandError) Unwrap() error {
+	switch e.CommandCode {
+	case 0x205f:
+		return ErrInitialSetupRejected
+	case 0x2054:
+		return ErrPanaAuthInfoRejected
+	case 0x2053:
+		return ErrBRouteStartRejected
+	case 0x2005:
+		return ErrUdpPortOpenRejected
+	case 0x2056:
+		return ErrPanaStartRejected
+	case 0x2051:
+		return ErrActiveScanRejected
+	default:
+		return ErrCommandRejected
+	}
+}
+
+// データ送信要求応答(0x2008)のデータ部
+//
+//	Data[0] = 結果コード
+//	Data[1] = 送信結果(0x00:送信成功, 0x01:再送失敗, 0x02:アドレス解決失敗)
+//	Data[2:] = 付加データ
+//
+// 付加データの中身はコマンドリファレンスに規定が無く、送信データとの対応も確かめられないので
+// 解釈せずにそのまま持つ
+type TransmitResult struct {
+	ResultCode     uint8  // 結果コード
+	TransmitResult uint8  // 送信結果
+	Trailer        []byte // 付加データ
+}
+
+// データ送信要求応答(0x2008)を解釈する
+// 足りないフィールドは0(付加データはnil)になる
+func ParseTransmitResult(r J11Datagram) TransmitResult {
+	var t TransmitResult
+	if len(r.Data) >= 1 {
+		t.ResultCode = r.Data[0]
+	}
+	if len(r.Data) >= 2 {
+		t.TransmitResult = r.Data[1]
+	}
+	if len(r.Data) > 2 {
+		t.Trailer = r.Data[2:]
+	}
+	return t
+}
+
+// データ送信要求応答(0x2008)が失敗を示した
+type TransmitError struct {
+	ResultCode     uint8 // 結果コード
+	TransmitResult uint8 // 送信結果
+}
+
+// データ送信要求応答(0x2008)からエラーを作る
+func NewTransmitError(r J11Datagram) *TransmitError {
+	t := ParseTransmitResult(r)
+	return &TransmitError{ResultCode: t.ResultCode, TransmitResult: t.TransmitResult}
+}
+
+func (e *TransmitError) Error() string {
+	var s string
+	switch e.TransmitResult {
+	case 0x00:
+		s = "送信成功"
+	case 0x01:
+		s = "再送失敗(ACK無し)"
+	case 0x02:
+		s = "アドレス解決失敗(Neighbor not found)"
+	default:
+		s = "不明な送信結果"
+	}
+	return fmt.Sprintf("transmit failed: result code:0x%02x, transmit result:0x%02x(%s)", e.ResultCode, e.TransmitResult, s)
+}
+
+// 再送すれば成功する見込みがあるならtrue
+func (e *TransmitError) Temporary() bool {
+	switch e.TransmitResult {
+	case 0x01, 0x02:
+		return true
+	default:
+		return false
 	}
 }
 
 // データ送信要求コマンド
-func CommandTransmitData(ipv6 netip.Addr, payload []byte) (J11Datagram, error) {
+// MessageLenは4(ヘッダ部チェックサムとデータ部チェックサム)+22(アドレス、ポート番号、送信データ長)+len(payload)になる
+func CommandTransmitData(ipv6 netip.Addr, srcPort uint16, dstPort uint16, payload []byte) (J11Datagram, error) {
 	data := ipv6.AsSlice() // 送信元IPv6アドレス(16バイト)
 	if len(data) == 16 {
-		data = binary.BigEndian.AppendUint16(data, 0x0e1a)               // 送信元ポート番号(2バイト)
-		data = binary.BigEndian.AppendUint16(data, 0x0e1a)               // 送信先ポート番号(2バイト)
+		data = binary.BigEndian.AppendUint16(data, srcPort)              // 送信元ポート番号(2バイト)
+		data = binary.BigEndian.AppendUint16(data, dstPort)              // 送信先ポート番号(2バイト)
 		data = binary.BigEndian.AppendUint16(data, uint16(len(payload))) // 送信データ長(2バイト)
 		data = append(data, payload...)                                  // 送信データ(任意バイト)
-		command := J11Datagram{
-			Header: J11DatagramHeader{
-				UniqueCode:     UniqueCodeRequestCommand,
-				CommandCode:    0x0008,
-				MessageLen:     4 + uint16(len(data)),
-				HeaderChecksum: 0,
-				DataChecksum:   0,
-			},
-			Data: data,
-		}
-		command.Header.HeaderChecksum = command.Header.CalcHeaderChecksum()
-		command.Header.DataChecksum = CalcChecksum(command.Data)
-		return command, nil
+		return newCommand(0x0008, data), nil
 	} else {
 		return J11Datagram{}, errors.New("bad ipv6 address")
 	}
 }
+
+// コマンド応答を待っている呼び出し元へ届ける仕掛け
+// 応答コマンドコード毎に待っている順で1つずつ届ける
+type ResponseRouter struct {
+	mu      sync.Mutex
+	waiters map[uint16][]chan J11Datagram
+}
+
+func NewResponseRouter() *ResponseRouter {
+	return &ResponseRouter{waiters: make(map[uint16][]chan J11Datagram)}
+}
+
+// 指定の応答コマンドコードを待つ
+// 応答を取りこぼさないように要求コマンドを発行する前に呼ぶこと
+// 待つのをやめるときは返却した関数を呼ぶ
+func (rr *ResponseRouter) Expect(commandCode uint16) (<-chan J11Datagram, func()) {
+	ch := make(chan J11Datagram, 1)
+	rr.mu.Lock()
+	rr.waiters[commandCode] = append(rr.waiters[commandCode], ch)
+	rr.mu.Unlock()
+	cancel := func() {
+		rr.mu.Lock()
+		defer rr.mu.Unlock()
+		waiters := rr.waiters[commandCode]
+		for i, w := range waiters {
+			if w == ch {
+				rr.waiters[commandCode] = append(waiters[:i:i], waiters[i+1:]...)
+				break
+			}
+		}
+		if len(rr.waiters[commandCode]) == 0 {
+			delete(rr.waiters, commandCode)
+		}
+	}
+	return ch, cancel
+}
+
+// コマンド応答を待っている呼び出し元へ届ける
+// 誰も待っていない応答は記録して捨てる
+func (rr *ResponseRouter) Deliver(r J11Datagram) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	waiters := rr.waiters[r.Header.CommandCode]
+	if len(waiters) == 0 {
+		slog.Warn("unexpected response", "commandCode", fmt.Sprintf("0x%04x", r.Header.CommandCode), "data", hex.EncodeToString(r.Data))
+		return
+	}
+	waiters[0] <- r // 容量1のチャネルに1回だけ送るのでブロックしない
+	if len(waiters) == 1 {
+		delete(rr.waiters, r.Header.CommandCode)
+	} else {
+		rr.waiters[r.Header.CommandCode] = waiters[1:]
+	}
+}
+
+// UART通信読み取り
+// 受信したコマンドの種類
+type DatagramKind int
+
+const (
+	DatagramUnknown  DatagramKind = iota // 規定外
+	DatagramResponse                     // コマンド応答(0x2xxx)
+	DatagramNotify                       // 通知(0x4xxx, 0x6xxx)
+)
+
+// コマンドコードから受信したコマンドの種類を決める
+//
+//	0x2000～0x2fff: 要求コマンドに対する応答(要求のコマンドコード+0x2000)
+//	0x4000～0x4fff: アクティブスキャンなどの通知
+//	0x6000～0x6fff: 起動完了、PANA認証結果、データ受信などの通知
+//
+// それ以外(要求コマンドのエコーなど)はDatagramUnknown
+func ClassifyCommandCode(code uint16) DatagramKind {
+	switch code & 0xf000 {
+	case 0x2000:
+		return DatagramResponse
+	case 0x4000, 0x6000:
+		return DatagramNotify
+	default:
+		return DatagramUnknown
+	}
+}
+
+// シリアルポートの読み取りに失敗した(USBが抜かれたなど)
+var ErrSerialReadFailed = errors.New("serial port read failed")
+
+// シリアルポートから受信してコマンド応答と通知に振り分ける
+// 取り消されるか読み取りに失敗するまで続けて、終了した理由を返す
+func uartReceiver(ctx context.Context, rd io.Reader, router *ResponseRouter, rxNotify chan J11Datagram) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+			resp, err := readJ11ProtocolDatagram(ctx, rd)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err != nil {
+				// 読み取りデータ不足(io.EOF)以外はデバイスが無くなったとみなす
+				slog.Error("readJ11ProtocolDatagram", "err", err)
+				return fmt.Errorf("%w: %w", ErrSerialReadFailed, err)
+			}
+			if resp == nil {
+				continue
+			}
+			switch ClassifyCommandCode(resp.Header.CommandCode) {
+			case DatagramResponse:
+				router.Deliver(*resp) // コマンド応答を待っている呼び出し元へ届ける
+			case DatagramNotify:
+				select {
+				case rxNotify <- *resp: // 通知チャンネルへ送る
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			default:
+				// 思いがけないコマンドコードは通知と取り違えないように捨てる
+				slog.Warn("unknown command code", "commandCode", fmt.Sprintf("0x%04x", resp.Header.CommandCode), "data", hex.EncodeToString(resp.Data))
+			}
+		}
+	}
+}
+
+func readJ11ProtocolDatagram(ctx context.Context, rd io.Reader) (*J11Datagram, error) {
+	// d0 f9 ee 5d が検出できるまで入力を破棄し続ける
+	var preamble uint32
+	for preamble != UniqueCodeResponseCommand {
+		var b [1]byte
+		n, err := rd.Read(b[:])
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if n == 0 { // 読み取りデータ不足
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			default:
+				continue
+			}
+		}
+		preamble = preamble<<8 | uint32(b[0])
+	}
+	// ヘッダ部読み取り
+	var buf [J11DatagramHeaderBytes]byte
+	binary.BigEndian.PutUint32(buf[:], preamble)
+	for i := 4; i < J11DatagramHeaderBytes; {
+		n, err := rd.Read(buf[i:])
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if n == 0 { // 読み取りデータ不足
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			default:
+				continue
+			}
+		}
+		i += n
+	}
+	header := J11DatagramHeader{}
+	binary.Decode(buf[:], binary.BigEndian, &header)
+	// ヘッダ部チェックサム検査
+	if header.HeaderChecksum != header.CalcHeaderChecksum() {
+		slog.Debug(
+			"header checksum mismatched",
+			"checksum", header.CalcHeaderChecksum(),
+			"HeaderChecksum", header.HeaderChecksum,
+		)
+		return nil, nil
+	}
+	// データ部読み取り
+	if header.MessageLen < 4 {
+		slog.Debug("message length too short", "MessageLen", header.MessageLen)
+		return nil, nil
+	}
+	dataBytes := header.MessageLen - 4
+	data := make([]byte, dataBytes)
+	for i := 0; i < int(dataBytes); {
+		n, err := rd.Read(data[i:])
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if n == 0 { // 読み取りデータ不足
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			default:
+				continue
+			}
+		}
+		i += n
+	}
+	// データ部チェックサム検査
+	if header.DataChecksum != CalcChecksum(data) {
+		slog.Debug(
+			"data checksum mismatched",
+			"checksum", CalcChecksum(data),
+			"DataChecksum", header.DataChecksum,
+		)
+		return nil, nil
+	}
+
+	return &J11Datagram{Header: header, Data: data}, nil
+}
@@ -0,0 +1,423 @@
+// BP35Cx-J11を使ってスマートメータから電力消費量などを得る
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 Akihiro Yamamoto <github.com/ak1211>
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tarm/serial"
+)
+
+// 記録したJ11データグラムを再生するシリアルポート
+// 書き込まれたデータは覚えておき、respondがあれば書き込まれる毎にその応答を受信データに加える
+// 受信データが無ければ届くか閉じられるまでReadをブロックする
+type fakeSerialPort struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	rx      []byte
+	written [][]byte
+	closed  bool
+	// 1回のReadで返す最大バイト数(0なら制限しない)
+	chunk int
+	// 書き込まれたデータに対する受信データを返す
+	respond func(b []byte) []byte
+}
+
+func newFakeSerialPort(rx ...[]byte) *fakeSerialPort {
+	p := &fakeSerialPort{rx: bytes.Join(rx, nil)}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// 受信データを加える
+func (p *fakeSerialPort) feed(b []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rx = append(p.rx, b...)
+	p.cond.Broadcast()
+}
+
+func (p *fakeSerialPort) Read(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.rx) == 0 && !p.closed {
+		p.cond.Wait()
+	}
+	if len(p.rx) == 0 {
+		return 0, io.EOF
+	}
+	if p.chunk > 0 && len(b) > p.chunk {
+		b = b[:p.chunk]
+	}
+	n := copy(b, p.rx)
+	p.rx = p.rx[n:]
+	return n, nil
+}
+
+func (p *fakeSerialPort) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return 0, io.ErrClosedPipe
+	}
+	p.written = append(p.written, bytes.Clone(b))
+	if p.respond != nil {
+		p.rx = append(p.rx, p.respond(b)...)
+		p.cond.Broadcast()
+	}
+	return len(b), nil
+}
+
+func (p *fakeSerialPort) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	p.cond.Broadcast()
+	return nil
+}
+
+// 応答/通知コマンドのバイト列を作る
+func responseBytes(commandCode uint16, data []byte) []byte {
+	r := J11Datagram{
+		Header: J11DatagramHeader{
+			UniqueCode:  UniqueCodeResponseCommand,
+			CommandCode: commandCode,
+			MessageLen:  4 + uint16(len(data)),
+		},
+		Data: data,
+	}
+	r.Header.HeaderChecksum = r.Header.CalcHeaderChecksum()
+	r.Header.DataChecksum = CalcChecksum(data)
+	var buf bytes.Buffer
+	r.Write(&buf)
+	return buf.Bytes()
+}
+
+// 読み取りに失敗するシリアルポート
+type failingReader struct{ err error }
+
+func (r failingReader) Read(b []byte) (int, error) { return 0, r.err }
+
+func TestCalcChecksum(t *testing.T) {
+	// チェックサムは桁上がりを捨てる単純な16ビット加算(1の補数和のように桁上がりを折り返さない)
+	tests := []struct {
+		name string
+		data []byte
+		want uint16
+	}{
+		{"空", nil, 0},
+		{"ハードウェアリセット要求のヘッダ部", []byte{0xd0, 0xea, 0x83, 0xfc, 0x00, 0xd9, 0x00, 0x04}, 0x0416},
+		{"起動完了通知のヘッダ部", []byte{0xd0, 0xf9, 0xee, 0x5d, 0x60, 0x19, 0x00, 0x04}, 0x0391},
+		{"ファームウェアバージョン取得応答のデータ部", []byte{0x01, 0x04, 0x00, 0x01, 0x02, 0x00, 0x00, 0x00, 0x03}, 0x000b},
+		{"桁あふれ直前", bytes.Repeat([]byte{0xff}, 257), 0xffff},
+		{"桁あふれで下位2バイトだけが残る", bytes.Repeat([]byte{0xff}, 258), 0x00fe},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CalcChecksum(tt.data); got != tt.want {
+				t.Errorf("CalcChecksum() = 0x%04x, want 0x%04x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadJ11ProtocolDatagram(t *testing.T) {
+	// ファームウェアバージョン取得応答
+	valid := responseBytes(0x206b, []byte{0x01, 0x04, 0x00, 0x01, 0x02, 0x00, 0x00, 0x00, 0x03})
+	badHeader := bytes.Clone(valid)
+	badHeader[9]++ // ヘッダ部チェックサム
+	badData := bytes.Clone(valid)
+	badData[len(badData)-1]++ // データ部
+	shortLen := responseBytes(0x6019, nil)
+	shortLen[7] = 0x02 // メッセージ長 < 4
+	binaryPutHeaderChecksum(shortLen)
+	tests := []struct {
+		name  string
+		rx    []byte
+		chunk int
+		want  *J11Datagram
+	}{
+		{"正常", valid, 0, &J11Datagram{Header: J11DatagramHeader{CommandCode: 0x206b}, Data: valid[12:]}},
+		{"1バイトずつ届く", valid, 1, &J11Datagram{Header: J11DatagramHeader{CommandCode: 0x206b}, Data: valid[12:]}},
+		{"前にゴミがある", append([]byte{0x00, 0xd0, 0xf9, 0x12}, valid...), 0, &J11Datagram{Header: J11DatagramHeader{CommandCode: 0x206b}, Data: valid[12:]}},
+		{"ヘッダ部チェックサム不一致", badHeader, 0, nil},
+		{"データ部チェックサム不一致", badData, 0, nil},
+		{"メッセージ長が短すぎる", shortLen, 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			port := newFakeSerialPort(tt.rx)
+			port.chunk = tt.chunk
+			got, err := readJ11ProtocolDatagram(context.Background(), port)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want == nil {
+				if got != nil {
+					t.Errorf("got %+v, want nil", got)
+				}
+				return
+			}
+			if got == nil || got.Header.CommandCode != tt.want.Header.CommandCode || !bytes.Equal(got.Data, tt.want.Data) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// ヘッダ部を書き換えたバイト列のヘッダ部チェックサムを計算し直す
+func binaryPutHeaderChecksum(b []byte) {
+	sum := CalcChecksum(b[0:8])
+	b[8], b[9] = byte(sum>>8), byte(sum)
+}
+
+func TestReadJ11ProtocolDatagramResync(t *testing.T) {
+	// チェックサムの合わないデータグラムは捨てて、続くデータグラムは読める
+	valid := responseBytes(0x6019, []byte{0x02})
+	bad := bytes.Clone(valid)
+	bad[len(bad)-1]++
+	port := newFakeSerialPort(bad, valid)
+	ctx := context.Background()
+	if got, err := readJ11ProtocolDatagram(ctx, port); got != nil || err != nil {
+		t.Fatalf("corrupt datagram: got %+v, %v", got, err)
+	}
+	got, err := readJ11ProtocolDatagram(ctx, port)
+	if err != nil || got == nil || got.Header.CommandCode != 0x6019 {
+		t.Fatalf("valid datagram: got %+v, %v", got, err)
+	}
+}
+
+func TestReadJ11ProtocolDatagramError(t *testing.T) {
+	want := errors.New("device removed")
+	if _, err := readJ11ProtocolDatagram(context.Background(), failingReader{want}); !errors.Is(err, want) {
+		t.Errorf("err = %v, want %v", err, want)
+	}
+	// 閉じられて受信データが無ければ取り消されるまで待つ
+	port := newFakeSerialPort()
+	port.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := readJ11ProtocolDatagram(ctx, port); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestOpenSerialPortFunc(t *testing.T) {
+	port := newFakeSerialPort(responseBytes(0x6019, []byte{0x02}))
+	var config *serial.Config
+	saved := OpenSerialPortFunc
+	defer func() { OpenSerialPortFunc = saved }()
+	OpenSerialPortFunc = func(c *serial.Config) (SerialPort, error) {
+		config = c
+		return port, nil
+	}
+	stream, err := openSerialPort("/dev/fake", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	if config.Name != "/dev/fake" || config.Baud != DefaultBaud {
+		t.Errorf("config = %+v", config)
+	}
+	// 差し替えたシリアルポートから読める
+	got, err := readJ11ProtocolDatagram(context.Background(), stream)
+	if err != nil || got == nil || got.Header.CommandCode != 0x6019 {
+		t.Fatalf("got %+v, %v", got, err)
+	}
+	// 書き込んだコマンドが記録される
+	if _, err := CommandHardwareReset().Write(stream); err != nil {
+		t.Fatal(err)
+	}
+	if len(port.written) != 1 || !bytes.Equal(port.written[0][0:8], []byte{0xd0, 0xea, 0x83, 0xfc, 0x00, 0xd9, 0x00, 0x04}) {
+		t.Errorf("written = %x", port.written)
+	}
+}
+
+func TestTransmitError(t *testing.T) {
+	tests := []struct {
+		data      []byte
+		message   string
+		temporary bool
+	}{
+		{[]byte{0x02, 0x00}, "送信成功", false},
+		{[]byte{0x02, 0x01}, "再送失敗(ACK無し)", true},
+		{[]byte{0x02, 0x02}, "アドレス解決失敗(Neighbor not found)", true},
+		{[]byte{0x02, 0x03}, "不明な送信結果", false},
+		{[]byte{0x02, 0xff}, "不明な送信結果", false},
+	}
+	for _, tt := range tests {
+		r := J11Datagram{Header: J11DatagramHeader{CommandCode: 0x2008}, Data: tt.data}
+		var err error = NewTransmitError(r)
+		var transmitErr *TransmitError
+		if !errors.As(err, &transmitErr) {
+			t.Fatalf("%x: errors.As failed", tt.data)
+		}
+		if transmitErr.ResultCode != tt.data[0] || transmitErr.TransmitResult != tt.data[1] {
+			t.Errorf("%x: %+v", tt.data, transmitErr)
+		}
+		if !strings.Contains(err.Error(), tt.message) {
+			t.Errorf("%x: Error() = %q, want %q", tt.data, err.Error(), tt.message)
+		}
+		if transmitErr.Temporary() != tt.temporary {
+			t.Errorf("%x: Temporary() = %v, want %v", tt.data, transmitErr.Temporary(), tt.temporary)
+		}
+	}
+}
+
+func TestParseTransmitResult(t *testing.T) {
+	tests := []struct {
+		data []byte
+		want TransmitResult
+	}{
+		{nil, TransmitResult{}},
+		{[]byte{0x01}, TransmitResult{ResultCode: 0x01}},
+		{[]byte{0x01, 0x00}, TransmitResult{ResultCode: 0x01}},
+		{[]byte{0x01, 0x00, 0xaa, 0xbb}, TransmitResult{ResultCode: 0x01, Trailer: []byte{0xaa, 0xbb}}},
+	}
+	for _, tt := range tests {
+		got := ParseTransmitResult(J11Datagram{Data: tt.data})
+		if got.ResultCode != tt.want.ResultCode || got.TransmitResult != tt.want.TransmitResult || string(got.Trailer) != string(tt.want.Trailer) {
+			t.Errorf("ParseTransmitResult(%x) = %+v, want %+v", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestCommandChecksums(t *testing.T) {
+	rbid, err := ParseRouteBId("0123456789ABCDEF0123456789ABCDEF")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rbpassword, err := ParseRouteBPassword("abcdefghijkl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	transmit, err := CommandTransmitData(netip.MustParseAddr("fe80::21d:1290:1234:5678"), EchonetLitePort, EchonetLitePort, []byte{0x10, 0x81})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commands := map[string]J11Datagram{
+		"CommandGetFirmwareVersion":  CommandGetFirmwareVersion(),
+		"CommandHardwareReset":       CommandHardwareReset(),
+		"CommandInitialSetup":        CommandInitialSetup(4, DefaultInitialSetupOptions),
+		"CommandSetPanaAuthInfo":     CommandSetPanaAuthInfo(rbid, rbpassword),
+		"CommandBRouteStart":         CommandBRouteStart(),
+		"CommandBRouteTerminate":     CommandBRouteTerminate(),
+		"CommandActivescan":          CommandActivescan(DefaultScanDuration, DefaultScanChannelMask, rbid),
+		"CommandUdpPortOpen":         CommandUdpPortOpen(EchonetLitePort),
+		"CommandUdpPortClose":        CommandUdpPortClose(EchonetLitePort),
+		"CommandBRouteStartPana":     CommandBRouteStartPana(),
+		"CommandBRouteTerminatePana": CommandBRouteTerminatePana(),
+		"CommandTransmitData":        transmit,
+	}
+	for name, c := range commands {
+		h := c.Header
+		if h.UniqueCode != UniqueCodeRequestCommand {
+			t.Errorf("%s: UniqueCode = 0x%08x", name, h.UniqueCode)
+		}
+		if int(h.MessageLen) != 4+len(c.Data) {
+			t.Errorf("%s: MessageLen = %d, want %d", name, h.MessageLen, 4+len(c.Data))
+		}
+		if h.HeaderChecksum != h.CalcHeaderChecksum() {
+			t.Errorf("%s: HeaderChecksum = 0x%04x, want 0x%04x", name, h.HeaderChecksum, h.CalcHeaderChecksum())
+		}
+		if h.DataChecksum != CalcChecksum(c.Data) {
+			t.Errorf("%s: DataChecksum = 0x%04x, want 0x%04x", name, h.DataChecksum, CalcChecksum(c.Data))
+		}
+	}
+	// d0+ea+83+fc+00+d9+00+04 = 0x0416 (以前は0x0000と書かれていた)
+	if h := CommandHardwareReset().Header; h.HeaderChecksum != 0x0416 {
+		t.Errorf("CommandHardwareReset: HeaderChecksum = 0x%04x, want 0x0416", h.HeaderChecksum)
+	}
+}
+
+func TestCommandTransmitData(t *testing.T) {
+	address := netip.MustParseAddr("fe80::21d:1290:1234:5678")
+	// 1232バイト(データ送信要求コマンドで送れる送信データの最大長)の送信データ
+	maxPayload := make([]byte, 1232)
+	for i := range maxPayload {
+		maxPayload[i] = byte(i)
+	}
+	tests := []struct {
+		name    string
+		payload []byte
+		want    []byte // ヘッダ部、送信元IPv6アドレス、ポート番号、送信データ長、送信データ
+	}{
+		{
+			"空",
+			nil,
+			mustDecodeHex(t, "d0ea83fc 0008 001a 035b 03a3 fe80000000000000021d129012345678 0e1a 0e1a 0000"),
+		},
+		{
+			"Get要求",
+			mustDecodeHex(t, "1081 0001 05ff01 028801 62 03 e0 00 e7 00 e8 00"),
+			mustDecodeHex(t, "d0ea83fc 0008 002c 036d 08eb fe80000000000000021d129012345678 0e1a 0e1a 0012 1081 0001 05ff01 028801 62 03 e0 00 e7 00 e8 00"),
+		},
+		{
+			"最大長",
+			maxPayload,
+			append(mustDecodeHex(t, "d0ea83fc 0008 04ea 042f 568f fe80000000000000021d129012345678 0e1a 0e1a 04d0"), maxPayload...),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			command, err := CommandTransmitData(address, EchonetLitePort, EchonetLitePort, tt.payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// MessageLenはチェックサム(4バイト)とデータ部の長さ
+			if want := 4 + len(command.Data); int(command.Header.MessageLen) != want {
+				t.Errorf("MessageLen = %d, want %d", command.Header.MessageLen, want)
+			}
+			var buf bytes.Buffer
+			command.Write(&buf)
+			if !bytes.Equal(buf.Bytes(), tt.want) {
+				t.Errorf("CommandTransmitData() = %x, want %x", buf.Bytes(), tt.want)
+			}
+		})
+	}
+	// IPv6アドレスでなければエラー
+	for _, bad := range []netip.Addr{{}, netip.MustParseAddr("192.168.0.1")} {
+		if _, err := CommandTransmitData(bad, EchonetLitePort, EchonetLitePort, nil); err == nil {
+			t.Errorf("CommandTransmitData(%v) returned no error", bad)
+		}
+	}
+}
+
+// 任意のバイト列を受信してもパニックせずに、チェックサムの合うデータグラムだけを返す
+func FuzzReadJ11ProtocolDatagram(f *testing.F) {
+	f.Add(responseBytes(0x206b, []byte{0x01, 0x04, 0x00, 0x01, 0x02, 0x00, 0x00, 0x00, 0x03}))
+	f.Add(responseBytes(0x6019, nil))
+	f.Add(append([]byte{0xd0, 0xf9, 0xee, 0x5d}, responseBytes(0x4051, []byte{0x01, 0x04})...))
+	exhausted := errors.New("exhausted")
+	f.Fuzz(func(t *testing.T, rx []byte) {
+		// 受信データを読み終えたらエラーを返して読み取りを終える
+		rd := io.MultiReader(bytes.NewReader(rx), failingReader{exhausted})
+		for {
+			r, err := readJ11ProtocolDatagram(context.Background(), rd)
+			if err != nil {
+				if !errors.Is(err, exhausted) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if r == nil {
+				continue
+			}
+			if r.Header.UniqueCode != UniqueCodeResponseCommand ||
+				int(r.Header.MessageLen) != 4+len(r.Data) ||
+				r.Header.HeaderChecksum != r.Header.CalcHeaderChecksum() ||
+				r.Header.DataChecksum != CalcChecksum(r.Data) {
+				t.Fatalf("returned a bad datagram %+v", r)
+			}
+		}
+	})
+}
@@ -11,11 +11,16 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log/slog"
-	"net/netip"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/tarm/serial"
@@ -24,46 +29,203 @@ import (
 
 // 設定
 type Settings struct {
-	RouteBId       string `json:"RouteBId"`
-	RouteBPassword string `json:"RouteBPassword"`
-	Channel        int    `json:"Channel"`
-	MacAddress     string `json:"MacAddress"`
-	PanId          int    `json:"PanId"`
+	// 設定ファイルの形式(無ければ0)
+	Version  int    `json:"Version"`
+	RouteBId string `json:"RouteBId"`
+	// 空なら環境変数BROUTE_PASSWORDかRouteBPasswordFileから読む
+	RouteBPassword string `json:"RouteBPassword,omitempty"`
+	// ルートBパスワードだけを書いたファイル(パーミッションは0600にすること)
+	RouteBPasswordFile string `json:"RouteBPasswordFile,omitempty"`
+	Channel            int    `json:"Channel"`
+	MacAddress         string `json:"MacAddress"`
+	PanId              int    `json:"PanId"`
+	// UART読み取りタイムアウト値(例: "90s") 空なら既定値
+	UartReadTimeout string `json:"UartReadTimeout,omitempty"`
+	// 送信元(オープンする)UDPポート番号 0なら0x0e1a(3610)
+	UdpPort int `json:"UdpPort,omitempty"`
+	// 送信先(スマートメーター)のUDPポート番号 0なら0x0e1a(3610)
+	MeterUdpPort int `json:"MeterUdpPort,omitempty"`
+	// シリアルポートのボーレート 0なら115200
+	Baud int `json:"Baud,omitempty"`
 }
 
-// タイムアウト値
-const UartReadTimeout time.Duration = 90 * time.Second
+// 設定ファイルの形式
+// 0: Versionの無い最初の形式
+// 1: Versionを追加
+const SettingsVersion = 1
+
+// 古い形式の設定ファイルを今の形式にする
+func migrateSettings(settings *Settings) error {
+	if settings.Version > SettingsVersion {
+		return fmt.Errorf("settings file version %d is newer than supported version %d", settings.Version, SettingsVersion)
+	}
+	if settings.Version < 0 {
+		return fmt.Errorf("bad settings file version %d", settings.Version)
+	}
+	// 0から1へは項目の追加だけなので変換は要らない
+	settings.Version = SettingsVersion
+	return nil
+}
+
+// ルートBパスワードを渡す環境変数
+const RouteBPasswordEnv = "BROUTE_PASSWORD"
+
+// パスワードファイルからルートBパスワードを読む
+// 他のユーザーが読めるファイルなら警告する
+func readPasswordFile(name string) (string, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return "", err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		slog.Warn("password file is accessible by other users", "file", name, "mode", info.Mode().Perm())
+	}
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// ルートBパスワードを環境変数、パスワードファイル、設定ファイルの順に探す
+func resolvePassword(settings *Settings) error {
+	if password := os.Getenv(RouteBPasswordEnv); password != "" {
+		settings.RouteBPassword = password
+		return nil
+	}
+	if settings.RouteBPasswordFile != "" {
+		password, err := readPasswordFile(settings.RouteBPasswordFile)
+		if err != nil {
+			return err
+		}
+		settings.RouteBPassword = password
+	}
+	return nil
+}
+
+// タイムアウト値の既定値
+const DefaultUartReadTimeout time.Duration = 90 * time.Second
 
 var ErrUartReadTimeoutExceeded = errors.New("UART read timeout exceeded")
 
-// 積算電力量計測値を取得するechonet lite電文
-func getElCumlativeWattHour() []byte {
-	return []byte{
-		0x10, 0x81, // 0x1081 = echonet lite
-		0x00, 0x01, // tid
-		0x05, 0xff, 0x01, // home controller
-		0x02, 0x88, 0x01, // smartmeter
-		0x62, // get要求
-		0x01, // 1つ
-		0xe0, // 積算電力量計測値(正方向計測値)
-		0x00, // 送信するデータ無し
+// シリアルポート
+type SerialPort interface {
+	io.Reader
+	io.Writer
+	io.Closer
+}
+
+// シリアルポートを開く関数
+// 実機が無くても動かせるように差し替えられる
+var OpenSerialPortFunc = func(config *serial.Config) (SerialPort, error) {
+	port, err := serial.OpenPort(config)
+	if err != nil {
+		return nil, err
 	}
+	return port, nil
 }
 
-// 瞬時電力と瞬時電流計測値を取得するechonet lite電文
-func getElInstantWattAmpere() []byte {
-	return []byte{
-		0x10, 0x81, // 0x1081 = echonet lite
-		0x00, 0x01, // tid
-		0x05, 0xff, 0x01, // home controller
-		0x02, 0x88, 0x01, // smartmeter
-		0x62, // get要求
-		0x02, // 2つ
-		0xe7, // 瞬時電力計測値
-		0x00, // 送信するデータ無し
-		0xe8, // 瞬時電流計測値
-		0x00, // 送信するデータ無し
+// シリアルデバイスが存在しない
+var ErrSerialDeviceNotFound = errors.New("serial device not found")
+
+// シリアルポートを開けなかったときにやり直す方針
+// USBシリアルはアダプタのリセット後に一旦消えて現れ直すことがあるのでしばらく待つ
+var SerialOpenRetry = RetryPolicy{Count: 5, Backoff: time.Second}
+
+// 送受信したechonet lite電文の記録先(nilなら記録しない)
+// NewMeterで作るMeterはこの記録先を使う
+var Capture *FrameCapture
+
+// アダプタの初期設定(動作モード、HAN Sleep機能、送信電力)
+// NewMeterで作るMeterはこの設定を使う
+var InitialSetup = DefaultInitialSetupOptions
+
+// J11の既定のボーレート
+const DefaultBaud = 115200
+
+// 指定できるボーレート
+var StandardBauds = []int{9600, 19200, 38400, 57600, 115200, 230400, 460800, 921600}
+
+// シリアルポートのボーレート(0なら設定ファイルの値または115200)
+var SerialBaud int
+
+// 標準のボーレートでなければエラー
+func validateBaud(baud int) error {
+	if !slices.Contains(StandardBauds, baud) {
+		return fmt.Errorf("Baud %d is not a standard baud rate %v", baud, StandardBauds)
 	}
+	return nil
+}
+
+// シリアルポートを開く
+// baudが0なら115200にする
+// 開けなければ待ち時間を倍にしながらSerialOpenRetry.Count回までやり直す
+func openSerialPort(serialName string, baud int) (SerialPort, error) {
+	if baud == 0 {
+		baud = DefaultBaud
+	}
+	if err := validateBaud(baud); err != nil {
+		return nil, err
+	}
+	config := &serial.Config{
+		Name:        serialName,
+		Baud:        baud,
+		ReadTimeout: 10 * time.Second,
+		Size:        8,
+	}
+	backoff := SerialOpenRetry.Backoff
+	for retry := 0; ; retry++ {
+		stream, err := OpenSerialPortFunc(config)
+		if err == nil {
+			return stream, nil
+		}
+		if retry >= SerialOpenRetry.Count {
+			slog.Error("OpenPort", "err", err)
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil, fmt.Errorf("%w: %s (run \"ports\" to list serial devices): %w", ErrSerialDeviceNotFound, serialName, err)
+			}
+			return nil, fmt.Errorf("could not open %s after %d attempts: %w", serialName, retry+1, err)
+		}
+		slog.Warn("OpenPort", slog.Int("retry", retry+1), slog.Duration("backoff", backoff), "err", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// "001D129012345678"や"00:1D:12:90:12:34:56:78"の形式のMACアドレスを解釈する
+func parseMacAddress(s string) (uint64, error) {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, ":", ""))
+	if err != nil {
+		return 0, fmt.Errorf("bad mac address %q: %w", s, err)
+	}
+	if len(b) != 8 {
+		return 0, fmt.Errorf("bad mac address %q: must be 8 bytes", s)
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+// "4,5,6"や"4-17"の形式のチャネル指定を解釈する
+func parseChannels(s string) ([]uint8, error) {
+	var channels []uint8
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		first, last, isRange := strings.Cut(field, "-")
+		from, err := strconv.ParseUint(first, 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("bad channel %q: %w", field, err)
+		}
+		to := from
+		if isRange {
+			to, err = strconv.ParseUint(last, 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("bad channel %q: %w", field, err)
+			}
+		}
+		for ch := from; ch <= to; ch++ {
+			channels = append(channels, uint8(ch))
+		}
+	}
+	return channels, nil
 }
 
 // スマートメーターを探す
@@ -71,593 +233,731 @@ func pairing(
 	settingsFileName string,
 	serialName string,
 	scanDuration uint8,
+	channelMask uint32,
+	scanRetries int,
 	rbid RouteBId,
 	rbpassword RouteBPassword,
+	passwordFile string,
+	omitPassword bool,
+	macAddress uint64,
+	timeout time.Duration,
 ) error {
-	config := &serial.Config{
-		Name:        serialName,
-		Baud:        115200,
-		ReadTimeout: 10 * time.Second,
-		Size:        8,
+	stream, err := openSerialPort(serialName, SerialBaud)
+	if err != nil {
+		return err
+	}
+	var uartReadTimeout string
+	if timeout > 0 {
+		uartReadTimeout = timeout.String()
 	}
-	stream, err := serial.OpenPort(config)
+	meter, err := NewMeter(stream, Settings{
+		RouteBId:        string(rbid[:]),
+		RouteBPassword:  string(rbpassword[:]),
+		Channel:         0x04,
+		UartReadTimeout: uartReadTimeout,
+	})
 	if err != nil {
+		stream.Close()
 		return err
 	}
+	defer meter.Close()
 
-	// コマンド応答チャネル
-	rxDataChan := make(chan J11Datagram, 64)
-	defer close(rxDataChan)
-	// 通知チャネル
-	rxNotifyChan := make(chan J11Datagram, 64)
-	defer close(rxNotifyChan)
+	// SIGINTを受け取ったら終了する
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-	go uartReceiver(ctx, stream, rxDataChan, rxNotifyChan)
-
-	//
-	// ハードウェアリセット要求コマンドを発行する
-	//
-	_, err = CommandHardwareReset().Write(stream)
+	// 検出したスマートメーターの情報
+	beacons, err := meter.ActiveScan(ctx, scanDuration, channelMask, scanRetries)
 	if err != nil {
 		return err
 	}
-	// 起動完了通知: 0x6019を確認するまで待つ
-	for done := false; !done; {
-		select {
-		case r := <-rxNotifyChan:
-			done = r.Header.CommandCode == 0x6019
-		case <-time.After(UartReadTimeout):
-			return errors.New("J11 UART hardware reset command has no response")
-		}
+	fmt.Println("応答のあったスマートメーター:")
+	for _, beacon := range beacons {
+		fmt.Printf("  MAC:%016x channel:%d PAN ID:%04x RSSI:%d dBm\n", beacon.macAddress, beacon.channel, beacon.panId, beacon.rssi)
+	}
+	// 指定が無ければRSSIの一番強いものを選ぶ
+	found, err := SelectBeacon(beacons, macAddress)
+	if err != nil {
+		return err
 	}
+	slog.Info("Selected smartmeter", "beacon", found)
 
-	//
-	// 初期設定要求コマンドを発行する
-	//
-	_, err = CommandInitialSetup(0x04).Write(stream)
+	// 設定ファイルに見つかったスマートメーターの情報を保存する
+	settings := Settings{
+		RouteBId:   string(rbid[:]),
+		Channel:    int(found.channel),
+		MacAddress: strconv.FormatUint(found.macAddress, 16),
+		PanId:      int(found.panId),
+		// 指定があればタイムアウト値とボーレートも保存する
+		UartReadTimeout: uartReadTimeout,
+		Baud:            SerialBaud,
+	}
+	// パスワードファイルを使うならパスワードを設定ファイルに書かない
+	switch {
+	case passwordFile != "":
+		settings.RouteBPasswordFile = passwordFile
+	case omitPassword:
+	default:
+		settings.RouteBPassword = string(rbpassword[:])
+	}
+	err = saveSettings(settingsFileName, settings)
 	if err != nil {
 		return err
 	}
-	// 応答コマンドコード:0x205f, 結果コード:0x01を確認する
-	for done := false; !done; {
-		select {
-		case r := <-rxDataChan:
-			if r.Header.CommandCode == 0x205f {
-				done = true
-				if r.Data[0] == 1 {
-					slog.Debug("CommandInitialSetup", slog.String("result", "ok"))
-				} else {
-					return fmt.Errorf("CommandInitialSetup: %#v", r)
-				}
-			}
-		case <-time.After(UartReadTimeout):
-			return ErrUartReadTimeoutExceeded
-		}
+
+	slog.Info("Bye")
+
+	return nil
+}
+
+// アダプタのファームウェアバージョンを表示する
+func firmware(serialName string, timeout time.Duration) error {
+	stream, err := openSerialPort(serialName, SerialBaud)
+	if err != nil {
+		return err
+	}
+	settings := Settings{}
+	if timeout > 0 {
+		settings.UartReadTimeout = timeout.String()
 	}
+	meter, err := NewMeter(stream, settings)
+	if err != nil {
+		stream.Close()
+		return err
+	}
+	defer meter.Close()
 
-	//
-	// BルートPANA認証情報設定要求コマンドを発行する
-	//
-	_, err = CommandSetPanaAuthInfo(rbid, rbpassword).Write(stream)
+	// SIGINTを受け取ったら終了する
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	err = meter.reset(ctx)
 	if err != nil {
 		return err
 	}
-	// 応答コマンドコード:0x2054, 結果コード:0x01を確認する
-	for done := false; !done; {
-		select {
-		case r := <-rxDataChan:
-			if r.Header.CommandCode == 0x2054 {
-				done = true
-				if r.Data[0] == 1 {
-					slog.Debug("CommandSetPanaAuthInfo", slog.String("result", "ok"))
-				} else {
-					return fmt.Errorf("CommandSetPanaAuthInfo: %#v", r)
-				}
-			}
-		case <-time.After(UartReadTimeout):
-			return ErrUartReadTimeoutExceeded
-		}
+	version, err := meter.GetFirmwareVersion(ctx)
+	if err != nil {
+		return err
 	}
+	fmt.Println(version)
+	return nil
+}
 
-	//
-	// アクティブスキャン要求コマンドを発行する
-	//
-	_, err = CommandActivescan(scanDuration, rbid).Write(stream)
+// アダプタと通信できるか確かめる
+// シリアルポートを開いてハードウェアリセットとファームウェアバージョン取得を行い、手順毎に結果を表示する
+// ルートB認証情報は使わないのでpairingの前に配線を確かめられる
+func selftest(w io.Writer, serialName string, timeout time.Duration) error {
+	result := func(step string, start time.Time, err error) error {
+		if err != nil {
+			fmt.Fprintf(w, "NG  %s: %v\n", step, err)
+			return fmt.Errorf("selftest failed at %s: %w", step, err)
+		}
+		fmt.Fprintf(w, "OK  %s (%s)\n", step, time.Since(start).Round(time.Millisecond))
+		return nil
+	}
+	start := time.Now()
+	stream, err := openSerialPort(serialName, SerialBaud)
+	if err := result("open "+serialName, start, err); err != nil {
+		return err
+	}
+	settings := Settings{}
+	if timeout > 0 {
+		settings.UartReadTimeout = timeout.String()
+	}
+	meter, err := NewMeter(stream, settings)
 	if err != nil {
+		stream.Close()
 		return err
 	}
-	// アクティブスキャン結果を受け取るチャネル(探しているのはスマートメーターなので1つあれば良い)
-	foundBeaconChan := make(chan BeaconResponse, 1)
-	defer close(foundBeaconChan)
-	// アクティブスキャン通知を処理するゴルーチンを起動する
-	go handleNotifyActivescan(ctx, rxNotifyChan, foundBeaconChan)
-	// 応答コマンドコード:0x2051, 結果コード:0x01を確認する
-	for done := false; !done; {
-		select {
-		case r := <-rxDataChan:
-			if r.Header.CommandCode == 0x2051 {
-				done = true
-				if r.Data[0] == 1 {
-					slog.Debug("CommandActivescan", slog.String("result", "ok"))
-				} else {
-					return fmt.Errorf("CommandActivescan: %#v", r)
-				}
-			}
-		case <-time.After(UartReadTimeout):
-			return ErrUartReadTimeoutExceeded
+	defer meter.Close()
+
+	// SIGINTを受け取ったら終了する
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	start = time.Now()
+	if err := result("hardware reset", start, meter.reset(ctx)); err != nil {
+		return err
+	}
+	start = time.Now()
+	version, err := meter.GetFirmwareVersion(ctx)
+	if err := result("firmware version", start, err); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "firmware: %s\n", version)
+	return nil
+}
+
+// スマートメーターに接続するのに必要な設定を検査する
+// 手で書き換えた設定ファイルの誤りを接続する前に見つける
+func validateSettings(settings Settings) error {
+	if settings.Channel < 4 || 17 < settings.Channel {
+		return fmt.Errorf("Channel %d is out of range(4～17)", settings.Channel)
+	}
+	if settings.PanId <= 0 || 0xffff < settings.PanId {
+		return fmt.Errorf("PanId %d is out of range(1～65535)", settings.PanId)
+	}
+	mac, err := strconv.ParseUint(settings.MacAddress, 16, 64)
+	if err != nil {
+		return fmt.Errorf("MacAddress %q is not a 64bit hexadecimal number", settings.MacAddress)
+	}
+	if mac == 0 {
+		return errors.New("MacAddress is zero")
+	}
+	if settings.Baud != 0 {
+		if err := validateBaud(settings.Baud); err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
-	// 検出したスマートメーターの情報
-	var found BeaconResponse
-	select {
-	case found = <-foundBeaconChan:
-		slog.Info("Found smartmeter", "beacon", found)
+// 設定ファイルを読み込む
+// 設定ファイル名を"-"にすると環境変数BROUTEJ11_SETTINGSまたは標準入力から読む
+func loadSettings(settingsFileName string) (Settings, error) {
+	settings := Settings{}
+	var jsonbytes []byte
+	var err error
+	if settingsFileName == SettingsStdin {
+		jsonbytes, err = readStdinSettings()
+	} else {
+		jsonbytes, err = os.ReadFile(settingsFileName)
+	}
+	if err != nil {
+		slog.Error("ReadFile", "err", err)
+		return settings, err
+	}
+	err = json.Unmarshal(jsonbytes, &settings)
+	if err != nil {
+		slog.Error("Unmarshal", "err", err)
+		return settings, err
+	}
+	err = migrateSettings(&settings)
+	if err != nil {
+		return settings, err
+	}
+	return settings, nil
+}
+
+// 設定ファイルの代わりに環境変数または標準入力から設定を読むときの設定ファイル名
+const SettingsStdin = "-"
 
-	case <-time.After(UartReadTimeout):
-		return ErrUartReadTimeoutExceeded
+// 設定のJSONを入れておく環境変数
+const SettingsEnv = "BROUTEJ11_SETTINGS"
+
+// 環境変数BROUTEJ11_SETTINGSがあればその値を、無ければ標準入力から設定のJSONを読む
+// 標準入力は1回しか読めないので読んだ内容を覚えておく
+var readStdinSettings = sync.OnceValues(func() ([]byte, error) {
+	if s, ok := os.LookupEnv(SettingsEnv); ok {
+		return []byte(s), nil
 	}
+	return io.ReadAll(os.Stdin)
+})
 
-	// 設定ファイルに見つかったスマートメーターの情報を保存する
-	settings := Settings{
-		RouteBId:       string(rbid[:]),
-		RouteBPassword: string(rbpassword[:]),
-		Channel:        int(found.channel),
-		MacAddress:     strconv.FormatUint(found.macAddress, 16),
-		PanId:          int(found.panId),
+// 設定ファイルに書き込む
+// 設定ファイル名が"-"なら書き込むファイルが無いので何もしない
+func saveSettings(settingsFileName string, settings Settings) error {
+	if settingsFileName == SettingsStdin {
+		slog.Warn("settings are not saved", "channel", settings.Channel, "macAddress", settings.MacAddress, "panId", settings.PanId)
+		return nil
 	}
+	settings.Version = SettingsVersion
 	jsonbytes, err := json.MarshalIndent(settings, "", strings.Repeat(" ", 2))
 	if err != nil {
 		slog.Error("MarshalIndent", "err", err)
 		return err
 	}
-
-	err = os.WriteFile(settingsFileName, jsonbytes, 0644)
+	// パスワードを含むことがあるので他のユーザーから読めないようにする
+	err = os.WriteFile(settingsFileName, jsonbytes, 0600)
 	if err != nil {
 		slog.Error("WriteFile", "err", err)
 		return err
 	}
+	// 既存のファイルはWriteFileでパーミッションが変わらないので変えておく
+	err = os.Chmod(settingsFileName, 0600)
+	if err != nil {
+		slog.Error("Chmod", "err", err)
+		return err
+	}
+	return nil
+}
 
-	slog.Info("Bye")
+// スマートメーターに接続する
+// 接続時にアクティブスキャンで探し直していたら、次回は探し直さずに済むように
+// 見つかったスマートメーターの情報を設定ファイルに保存する
+func connectMeter(ctx context.Context, meter *Meter, settingsFileName string) error {
+	err := meter.Connect(ctx)
+	if err != nil {
+		return err
+	}
+	found, ok := meter.Rescanned()
+	if !ok {
+		return nil
+	}
+	settings, err := loadSettings(settingsFileName)
+	if err != nil {
+		return err
+	}
+	settings.Channel = int(found.channel)
+	settings.MacAddress = strconv.FormatUint(found.macAddress, 16)
+	settings.PanId = int(found.panId)
+	slog.Info("update settings", "channel", settings.Channel, "macAddress", settings.MacAddress, "panId", settings.PanId)
+	return saveSettings(settingsFileName, settings)
+}
 
-	return nil
+// 起動に掛かった時間を段階毎にログに出す
+type startupTimer struct {
+	start time.Time
+	last  time.Time
+	done  bool
 }
 
-// 0x4051: アクティブスキャン通知を処理する
-func handleNotifyActivescan(ctx context.Context, rxNotify chan J11Datagram, found chan BeaconResponse) {
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case r := <-rxNotify:
-			if r.Header.CommandCode == 0x4051 {
-				// Data[0] = スキャン結果
-				// Data[1] = スキャンチャネル
-				// スキャン結果 = 0なら以下の情報が付加される
-				// Data[2] = スキャン数
-				// Data[3,4,5,6,7,8,9,10] = MACアドレス
-				// Data[11,12] = PANID
-				// Data[13] = rssi
-				resultCode := r.Data[0]
-				channel := r.Data[1]
-				if resultCode == 0 {
-					// Beacon応答あり
-					macAddress := binary.BigEndian.Uint64(r.Data[3:11])
-					panId := binary.BigEndian.Uint16(r.Data[11:13])
-					rssi := int8(r.Data[13])
-					// スマートメーターを検出した
-					found <- BeaconResponse{
-						channel:    channel,
-						macAddress: macAddress,
-						panId:      panId,
-						rssi:       rssi,
-					}
-				}
-				// Beacon応答無し
-				slog.Debug("NotifyActivescan", "resultCode", resultCode, "channel", channel)
-			}
-		}
+func newStartupTimer() *startupTimer {
+	now := time.Now()
+	return &startupTimer{start: now, last: now}
+}
+
+// 段階が終わったことを記録する
+// 最初の読み取りを記録したら以後は何もしない
+func (t *startupTimer) phase(name string) {
+	if t.done {
+		return
 	}
+	now := time.Now()
+	slog.Info("startup", "phase", name, "elapsed", now.Sub(t.last).Round(time.Millisecond), "total", now.Sub(t.start).Round(time.Millisecond))
+	t.last = now
+	t.done = name == "first reading"
 }
 
-// スマートメーターから電力消費量を得る
-func run(settingsFileName string, serialName string) error {
-	// 設定ファイルからスマートメーターの情報を得る
-	jsonbytes, err := os.ReadFile(settingsFileName)
+// --auto-repairでpairingをやり直すまでに接続を試みる回数
+const AutoRepairAfter = 2
+
+// 設定ファイルにあるルートB認証IDとパスワードでpairingをやり直して設定ファイルを更新する
+// UDPポート番号などpairingが書かない項目は元の設定を引き継ぐ
+func repairSettings(settingsFileName string, serialName string, timeout time.Duration, macAddress uint64) error {
+	saved, err := loadSettings(settingsFileName)
 	if err != nil {
-		slog.Error("ReadFile", "err", err)
 		return err
 	}
-	//
-	settings := Settings{}
-	err = json.Unmarshal(jsonbytes, &settings)
+	resolved := saved
+	if err := resolvePassword(&resolved); err != nil {
+		return err
+	}
+	rbid, err := ParseRouteBId(saved.RouteBId)
 	if err != nil {
-		slog.Error("Unmarshal", "err", err)
 		return err
 	}
-	var (
-		routeBId       RouteBId       = [32]byte([]byte(settings.RouteBId))
-		routeBPassword RouteBPassword = [12]byte([]byte(settings.RouteBPassword))
-	)
-	macAddress, err := strconv.ParseUint(settings.MacAddress, 16, 64)
+	rbpassword, err := ParseRouteBPassword(resolved.RouteBPassword)
 	if err != nil {
-		slog.Error("ParseUint", "err", err)
 		return err
 	}
-	//
-	config := &serial.Config{
-		Name:        serialName,
-		Baud:        115200,
-		ReadTimeout: 10 * time.Second,
-		Size:        8,
+	// 設定ファイルにパスワードが無ければ書かないままにする
+	omitPassword := saved.RouteBPassword == "" && saved.RouteBPasswordFile == ""
+	err = pairing(settingsFileName, serialName, DefaultScanDuration, DefaultScanChannelMask, DefaultScanRetries, rbid, rbpassword, saved.RouteBPasswordFile, omitPassword, macAddress, timeout)
+	if err != nil {
+		return err
 	}
-	stream, err := serial.OpenPort(config)
+	settings, err := loadSettings(settingsFileName)
 	if err != nil {
-		slog.Error("OpenPort", "err", err)
 		return err
 	}
+	settings.UdpPort = saved.UdpPort
+	settings.MeterUdpPort = saved.MeterUdpPort
+	if settings.UartReadTimeout == "" {
+		settings.UartReadTimeout = saved.UartReadTimeout
+	}
+	if settings.Baud == 0 {
+		settings.Baud = saved.Baud
+	}
+	return saveSettings(settingsFileName, settings)
+}
 
-	// コマンド応答チャネル
-	rxDataChan := make(chan J11Datagram, 64)
-	defer close(rxDataChan)
-	// 通知チャネル
-	rxNotifyChan := make(chan J11Datagram, 64)
-	defer close(rxNotifyChan)
-
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-	go uartReceiver(ctx, stream, rxDataChan, rxNotifyChan)
-
-	//
-	// ハードウェアリセット要求コマンドを発行する
+// 設定ファイルからスマートメーターの情報を得てシリアルポートを開く
+// timeoutが0でなければ設定ファイルの値より優先する
+// macAddressが空でなければ設定ファイルの値より優先して、そのスマートメーターだけに接続する
+func openMeter(settingsFileName string, serialName string, timeout time.Duration, macAddress uint64) (*Meter, error) {
+	settings, err := loadSettings(settingsFileName)
+	if err != nil {
+		return nil, err
+	}
+	err = resolvePassword(&settings)
+	if err != nil {
+		return nil, err
+	}
+	// コマンドラインの指定は設定ファイルより優先する
+	if timeout > 0 {
+		settings.UartReadTimeout = timeout.String()
+	}
+	if macAddress != 0 {
+		settings.MacAddress = strconv.FormatUint(macAddress, 16)
+	}
+	if SerialBaud != 0 {
+		settings.Baud = SerialBaud
+	}
+	if err := validateSettings(settings); err != nil {
+		return nil, fmt.Errorf("%s: %w", settingsFileName, err)
+	}
 	//
-	_, err = CommandHardwareReset().Write(stream)
+	stream, err := openSerialPort(serialName, settings.Baud)
+	if err != nil {
+		return nil, err
+	}
+	meter, err := NewMeter(stream, settings)
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	if macAddress != 0 {
+		meter.PinMacAddress()
+	}
+	return meter, nil
+}
+
+// スマートメーターが持つインスタンスを表示する
+func discover(settingsFileName string, serialName string, timeout time.Duration) error {
+	meter, err := openMeter(settingsFileName, serialName, timeout, 0)
 	if err != nil {
 		return err
 	}
-	// 起動完了通知: 0x6019を確認するまで待つ
-	for done := false; !done; {
-		select {
-		case r := <-rxNotifyChan:
-			done = r.Header.CommandCode == 0x6019
-		case <-time.After(UartReadTimeout):
-			return errors.New("J11 UART hardware reset command has no response")
-		}
+	defer meter.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	err = connectMeter(ctx, meter, settingsFileName)
+	if err != nil {
+		return err
 	}
 
-	//
-	// 初期設定要求コマンドを発行する
-	//
-	_, err = CommandInitialSetup(uint8(settings.Channel)).Write(stream)
+	// PANAセッション確立後に通知されたインスタンスリスト
+	fmt.Println("インスタンスリスト通知(0xd5):")
+	for _, eoj := range meter.Instances() {
+		fmt.Printf("  %s\n", formatEoj(eoj))
+	}
+	// ノードプロファイルの自ノードインスタンスリストS
+	eojs, err := meter.GetSelfNodeInstances(ctx)
 	if err != nil {
 		return err
 	}
-	// 応答コマンドコード:0x205f, 結果コード:0x01を確認する
-	for done := false; !done; {
-		select {
-		case r := <-rxDataChan:
-			if r.Header.CommandCode == 0x205f {
-				done = true
-				if r.Data[0] == 1 {
-					slog.Debug("CommandInitialSetup", slog.String("result", "ok"))
-				} else {
-					return fmt.Errorf("CommandInitialSetup: %#v", r)
-				}
-			}
-		case <-time.After(UartReadTimeout):
-			return ErrUartReadTimeoutExceeded
-		}
+	fmt.Println("自ノードインスタンスリストS(0xd6):")
+	for _, eoj := range eojs {
+		fmt.Printf("  %s\n", formatEoj(eoj))
 	}
+	return nil
+}
 
-	//
-	// BルートPANA認証情報設定要求コマンドを発行する
-	//
-	_, err = CommandSetPanaAuthInfo(routeBId, routeBPassword).Write(stream)
+// 任意のオブジェクトの任意のプロパティ値を読み出して表示する
+func get(settingsFileName string, serialName string, timeout time.Duration, deoj [3]byte, epcs []byte) error {
+	meter, err := openMeter(settingsFileName, serialName, timeout, 0)
 	if err != nil {
 		return err
 	}
-	// 応答コマンドコード:0x2054, 結果コード:0x01を確認する
-	for done := false; !done; {
-		select {
-		case r := <-rxDataChan:
-			if r.Header.CommandCode == 0x2054 {
-				done = true
-				if r.Data[0] == 1 {
-					slog.Debug("CommandSetPanaAuthInfo", slog.String("result", "ok"))
-				} else {
-					return fmt.Errorf("CommandSetPanaAuthInfo: %#v", r)
-				}
-			}
-		case <-time.After(UartReadTimeout):
-			return ErrUartReadTimeoutExceeded
-		}
+	defer meter.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	err = connectMeter(ctx, meter, settingsFileName)
+	if err != nil {
+		return err
 	}
 
-	//
-	// Bルート動作開始要求コマンドを発行する
-	//
-	_, err = CommandBRouteStart().Write(stream)
+	frame, err := meter.GetFrom(ctx, deoj, epcs...)
 	if err != nil {
 		return err
 	}
-	// 応答コマンドコード:0x2053, 結果コード:0x01を確認する
-	for done := false; !done; {
-		select {
-		case r := <-rxDataChan:
-			if r.Header.CommandCode == 0x2053 {
-				done = true
-				if r.Data[0] == 1 {
-					// channel,panid,macaddressは設定ファイルにあるので表示しない
-					//					var channel uint8 = r.Data[1]
-					//					var panId uint16 = binary.BigEndian.Uint16(r.Data[2:4])
-					//					var macAddress [8]byte = [8]byte(r.Data[4:12])
-					var rssi int8 = int8(r.Data[12])
-					slog.Debug("CommandBRouteStart",
-						slog.String("result", "ok"),
-						//						slog.Int("channel", int(channel)),
-						//						slog.String("panId", strconv.FormatInt(int64(panId), 16)),
-						//						slog.String("macAddress", hex.EncodeToString(macAddress[:])),
-						slog.Int("rssi", int(rssi)),
-					)
-				} else {
-					return fmt.Errorf("CommandBRouteStart: %#v", r)
-				}
+	frame.Show()
+	// 解釈できない値もあるので生の値も表示する
+	fmt.Printf("seoj:%s esv:0x%02x\n", hex.EncodeToString(frame.seoj[:]), frame.esv)
+	for _, edata := range frame.edata {
+		fmt.Printf("  epc:0x%02x %s pdc:%d edt:%s\n", edata.epc, EpcName(edata.epc), edata.pdc, hex.EncodeToString(edata.edt))
+	}
+	return nil
+}
+
+// "028801"の形式のEOJを解釈する
+func parseEoj(s string) ([3]byte, error) {
+	b, err := hex.DecodeString(strings.TrimPrefix(s, "0x"))
+	if err != nil {
+		return [3]byte{}, fmt.Errorf("bad eoj %q: %w", s, err)
+	}
+	if len(b) != 3 {
+		return [3]byte{}, fmt.Errorf("bad eoj %q: must be 3 bytes", s)
+	}
+	return [3]byte(b), nil
+}
+
+// "e7"や"0xe7"の形式のEPCを解釈する
+func parseEpc(s string) (byte, error) {
+	b, err := hex.DecodeString(strings.TrimPrefix(s, "0x"))
+	if err != nil {
+		return 0, fmt.Errorf("bad epc %q: %w", s, err)
+	}
+	if len(b) != 1 {
+		return 0, fmt.Errorf("bad epc %q: must be 1 byte", s)
+	}
+	return b[0], nil
+}
+
+// 16進数文字列のechonet lite電文を解釈して表示する
+// hexStringが空なら標準入力から読み込む
+func decode(hexString string, stdin io.Reader) error {
+	if hexString == "" {
+		b, err := io.ReadAll(stdin)
+		if err != nil {
+			return err
+		}
+		hexString = string(b)
+	}
+	// --capture-fileで記録したファイルなら電文毎に解釈する
+	if frames, ok := parseCapture(strings.NewReader(hexString)); ok {
+		for _, captured := range frames {
+			fmt.Printf("%s %s\n", captured.Time.Format(time.RFC3339Nano), captured.Direction)
+			if err := decodeFrame(captured.Data); err != nil {
+				slog.Error("decode", "err", err)
 			}
-		case <-time.After(UartReadTimeout):
-			return ErrUartReadTimeoutExceeded
 		}
+		return nil
+	}
+	// 空白や改行で区切られていても良い
+	hexString = strings.Join(strings.Fields(hexString), "")
+	b, err := hex.DecodeString(hexString)
+	if err != nil {
+		return fmt.Errorf("bad hex string: %w", err)
 	}
+	return decodeFrame(b)
+}
 
-	//
-	// UDPポートオープン要求コマンドを発行する
-	//
-	_, err = CommandUdpPortOpen(0x0e1a).Write(stream)
+// echonet lite電文を解釈して表示する
+func decodeFrame(b []byte) error {
+	frame, err := ParseEchonetliteFrame(b)
 	if err != nil {
 		return err
 	}
-	// 応答コマンドコード:0x2005, 結果コード:0x01を確認する
-	for done := false; !done; {
-		select {
-		case r := <-rxDataChan:
-			if r.Header.CommandCode == 0x2005 {
-				done = true
-				if r.Data[0] == 1 {
-					slog.Debug("CommandUdpPortOpen", slog.String("result", "ok"))
-				} else {
-					return fmt.Errorf("CommandUdpPortOpen: %#v", r)
-				}
+	fmt.Printf("ehd:%04x tid:%04x seoj:%s deoj:%s esv:0x%02x opc:%d\n",
+		frame.ehd, frame.tid, hex.EncodeToString(frame.seoj[:]), hex.EncodeToString(frame.deoj[:]), frame.esv, frame.opc)
+	frame.Show()
+	return nil
+}
+
+// EOJを表示用の文字列にする
+func formatEoj(eoj [3]byte) string {
+	var name string
+	switch [2]byte(eoj[0:2]) {
+	case [2]byte{0x02, 0x88}:
+		name = "低圧スマート電力量メータ"
+	case [2]byte{0x02, 0x8a}:
+		name = "高圧スマート電力量メータ"
+	case [2]byte{0x0e, 0xf0}:
+		name = "ノードプロファイル"
+	default:
+		name = "不明なクラス"
+	}
+	return fmt.Sprintf("%s %s", hex.EncodeToString(eoj[:]), name)
+}
+
+// 1回読み取るときに最初に読み出すプロパティの既定値
+// 積算電力量計測値の換算に必要な有効桁数と単位を1回の要求で済ませる
+// 係数(0xd3)は存在しないスマートメーターがあり、まとめて読むと不可応答(Get_SNA)になるので含めず、
+// あとで単独で読み出す
+var DefaultGreetingEpcs = []byte{
+	0xd7, // 積算電力量有効桁数
+	0xe1, // 積算電力量単位(正方向、逆方向計測値)
+	0xea, // 定時積算電力量計測値(正方向計測値)
+}
+
+// runコマンドのオプション
+type RunOptions struct {
+	// UART読み取りタイムアウト値(0なら設定ファイルの値)
+	Timeout time.Duration
+	// trueなら1回読み取って終了する(Intervalと同時には指定できない)
+	Once bool
+	// 瞬時電力と瞬時電流を読み取る間隔(0なら連続読み取りしない)
+	Interval time.Duration
+	// 積算電力量を読み取る間隔(0なら読み取らない)
+	CumulativeInterval time.Duration
+	// データ送信失敗時の再送方針
+	Retry RetryPolicy
+	// 計測値を公開するHTTPサーバーのアドレス(空なら公開しない)
+	MetricsAddr string
+	// 出力形式(OutputText, OutputJSON)
+	Output string
+	// 連続読み取り時にPANA認証をやり直すまでの連続タイムアウト回数(0ならやり直さない)
+	ReauthThreshold int
+	// 連続読み取り時にこの時間読み取りに成功しなければエラーで終了する(0なら終了しない)
+	ReadDeadline time.Duration
+	// 接続するスマートメーターのMACアドレス(0なら設定ファイルの値)
+	MacAddress uint64
+	// trueなら続けて接続に失敗したときにpairingをやり直す
+	AutoRepair bool
+	// 1回読み取るときに最初に読み出すプロパティ(空なら読み出さない)
+	GreetingEpcs []byte
+	// 計測値の出力先(nilなら出力しない)
+	Sink Sink
+}
+
+// スマートメーターから電力消費量を得る
+// Intervalを指定すると中断されるまで読み取り続け、そうでなければ1回読み取って終了する
+func run(settingsFileName string, serialName string, opts RunOptions) error {
+	if opts.Once && opts.Interval > 0 {
+		return errors.New("--onceと--intervalは同時に指定できません")
+	}
+	if opts.AutoRepair && settingsFileName == SettingsStdin {
+		return errors.New("--auto-repairは設定ファイルを更新するので--settings -とは同時に指定できません")
+	}
+	// SIGINTを受け取ったら終了する
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var (
+		meter  *Meter
+		report func(*EchonetliteFrame)
+	)
+	// シリアルポートを開き直したときは新しい方を閉じる
+	defer func() {
+		if meter != nil {
+			meter.Close()
+		}
+	}()
+	// シリアルポートを開いて計測値の出力先を用意する
+	open := func() error {
+		var err error
+		meter, err = openMeter(settingsFileName, serialName, opts.Timeout, opts.MacAddress)
+		if err != nil {
+			return err
+		}
+		meter.SetRetryPolicy(opts.Retry)
+		if report, err = newReporter(opts.Output, os.Stdout, meter); err != nil {
+			return err
+		}
+		report = serializeReport(withSink(ctx, report, opts.Sink, meter))
+		// 30分毎に通知される定時積算電力量計測値(0xea)も出力する
+		meter.OnNotify(report)
+		return nil
+	}
+	// 接続する
+	// --auto-repairなら続けて失敗したときにpairingをやり直して設定ファイルを更新してから接続し直す
+	connect := func() error {
+		err := connectMeter(ctx, meter, settingsFileName)
+		if err == nil || !opts.AutoRepair {
+			return err
+		}
+		for retry := 1; retry < AutoRepairAfter && ctx.Err() == nil; retry++ {
+			slog.Warn("connect failed, retrying", "err", err, "retry", retry)
+			if err = connectMeter(ctx, meter, settingsFileName); err == nil {
+				return nil
 			}
-		case <-time.After(UartReadTimeout):
-			return ErrUartReadTimeoutExceeded
 		}
+		if ctx.Err() != nil {
+			return err
+		}
+		slog.Warn("connect failed, re-pairing", "err", err)
+		meter.Close()
+		meter = nil
+		if err := repairSettings(settingsFileName, serialName, opts.Timeout, opts.MacAddress); err != nil {
+			return err
+		}
+		if err := open(); err != nil {
+			return err
+		}
+		return connectMeter(ctx, meter, settingsFileName)
 	}
 
-	//
-	// BルートPANA開始要求コマンドを発行する
-	//
-	_, err = CommandBRouteStartPana().Write(stream)
+	// 起動は「開く」「接続する」「最初の読み取り」の順に進める
+	// アダプタとの送受信は1つずつしかできず、echonet liteの送信はPANA認証の後なので、
+	// それ以外の準備(HTTPサーバーの起動)を先に始めて並行させる
+	startup := newStartupTimer()
+	if opts.MetricsAddr != "" {
+		go func() {
+			if err := serveMetrics(ctx, opts.MetricsAddr); err != nil {
+				slog.Error("serveMetrics", "err", err)
+			}
+		}()
+	}
+	if err := open(); err != nil {
+		return err
+	}
+	startup.phase("open")
+	err := connect()
 	if err != nil {
 		return err
 	}
-	// 応答コマンドコード:0x2056, 結果コード:0x01を確認する
-	for done := false; !done; {
-		select {
-		case r := <-rxDataChan:
-			if r.Header.CommandCode == 0x2056 {
-				done = true
-				if r.Data[0] == 1 {
-					slog.Debug("CommandBRouteStartPana", slog.String("result", "ok"))
-				} else {
-					return fmt.Errorf("CommandBRouteStartPana: %#v", r)
-				}
+	startup.phase("connect")
+
+	// 連続読み取り
+	if opts.Interval > 0 {
+		daemonStatus.SetConnected(true)
+		defer daemonStatus.SetConnected(false)
+		for {
+			// 最初の計測値を出力するまでの時間を記録する
+			report := func(frame *EchonetliteFrame) {
+				report(frame)
+				startup.phase("first reading")
 			}
-		case <-time.After(UartReadTimeout):
-			return ErrUartReadTimeoutExceeded
-		}
-	}
-	// 0x6028: PANA認証結果通知を確認するまで待つ
-	for done := false; !done; {
-		select {
-		case r := <-rxNotifyChan:
-			if r.Header.CommandCode == 0x6028 {
-				done = true
-				result, macAddress := parseNotifyPanaResult(r)
-				_ = macAddress // macAddressは設定ファイルにあるので、表示しない
-				switch result {
-				case 1: // 認証成功
-					slog.Info("connection successful") //						slog.String("macAddress", hex.EncodeToString(macAddress[:])),
-				case 2: // 認証失敗
-					return errors.New("PANA auth failed")
-				case 3: // 応答なし
-					return errors.New("no response to smart meter")
-				default: // 規定の無いコード
-					return fmt.Errorf("PANA auth failed:%v", result)
-				}
+			err = poll(ctx, meter, report, opts.Interval, opts.CumulativeInterval, opts.ReauthThreshold, opts.ReadDeadline)
+			if !errors.Is(err, ErrSerialReadFailed) {
+				break
+			}
+			// USBが抜かれたなどでシリアルポートが読めなくなったので開き直して続ける
+			daemonStatus.SetConnected(false)
+			slog.Error("serial port lost, reopening", "err", err)
+			meter.Close()
+			meter = nil
+			if err = open(); err != nil {
+				return err
+			}
+			if err = connect(); err != nil {
+				return err
 			}
-		case <-time.After(UartReadTimeout):
-			return ErrUartReadTimeoutExceeded
+			daemonStatus.SetConnected(true)
 		}
-	}
-
-	// MACアドレスからIPv6リンクローカルアドレスへ変換する
-	// MACアドレスの最初の1バイト下位2bit目を反転して
-	// 0xFE80000000000000XXXXXXXXXXXXXXXXのXXをMACアドレスに置き換える
-	address16 := [16]byte{}
-	binary.BigEndian.PutUint64(address16[0:8], 0xFE80_0000_0000_0000)
-	binary.BigEndian.PutUint64(address16[8:16], macAddress^0x0200_0000_0000_0000)
-	ipv6address := netip.AddrFrom16(address16)
-
-	// データ送信関数
-	transmit := func(c *ConnEchonetlite, b []byte) error {
-		_, err := c.Write(b)
 		if err != nil {
 			return err
 		}
-		// 応答コマンドコード:0x2008, 結果コード:0x01を確認する
-		for done := false; !done; {
-			select {
-			case r := <-rxDataChan:
-				if r.Header.CommandCode == 0x2008 {
-					done = true
-					if r.Data[0] == 1 {
-						slog.Debug("Write",
-							slog.String("transmit result", strconv.FormatInt(int64(r.Data[1]), 16)),
-							slog.String("data digest", hex.EncodeToString(r.Data[2:])))
-					} else {
-						return fmt.Errorf("Write: %#v", r)
-					}
-				}
-			case <-time.After(UartReadTimeout):
-				return ErrUartReadTimeoutExceeded
-			}
-		}
+		slog.Info("Bye")
 		return nil
 	}
-	// データ受信関数
-	receive := func(c *ConnEchonetlite) {
-		buffer := make([]byte, 1500) // 最大受信サイズはヘッダ部を含めて1361バイト
-		n, err := c.Read(buffer)
-		if err != nil {
-			slog.Error("read", "err", err)
-			return
-		}
-		frame, err := ParseEchonetliteFrame(buffer[:n])
+
+	// あいさつ代わりにスマートメータの属性を取得してみる
+	if len(opts.GreetingEpcs) > 0 {
+		// 1つの要求にまとめて読み出す
+		frame, err := meter.Get(ctx, opts.GreetingEpcs...)
 		if err != nil {
-			slog.Error("read", "err", err)
-			return
+			return err
 		}
-		frame.Show()
+		report(frame)
 	}
-
-	//
-	conn := NewConnEchonetlite(stream, ipv6address, rxNotifyChan)
-
-	// PANAセッション確立後のインスタンスリスト通知が送られてくるまで待つ
-	receive(conn)
-
-	// データを受信するゴルーチンを起動する
-	go func() {
-		for {
-			receive(conn)
+	// 積算電力量計測値の換算に必要な単位をあいさつで読み出せていなければ係数と一緒に読み出しておく
+	// 単位を読み出せていて係数を読み出していなければ係数だけ読み出す(無ければ係数は1のまま)
+	if _, err := meter.CumulativeScale(); err != nil {
+		if err := meter.LoadCumulativeScale(ctx); err != nil {
+			slog.Warn("LoadCumulativeScale", "err", err)
 		}
-	}()
-
-	// あいさつ代わりにスマートメータの属性を取得してみる
-	if true {
-		elSmartmeterProps := []EchonetliteEdata{
-			// go言語では初期値0なのでpdc,edtは省略する
-			{epc: 0x80}, // 動作状態
-			{epc: 0x88}, // 異常発生状態
-			{epc: 0x8a}, // メーカーコード
-			{epc: 0xd3}, // 係数(存在しない場合は×1倍)
-			{epc: 0xd7}, // 積算電力量有効桁数
-			{epc: 0xe1}, // 積算電力量単位(正方向、逆方向計測値)
-			{epc: 0xea}, // 定時積算電力量計測値(正方向計測値)
-		}
-		for _, item := range elSmartmeterProps {
-			elFrame := EchonetliteFrame{
-				ehd:   0x1081,
-				tid:   0x0001,
-				seoj:  [3]byte{0x05, 0xff, 0x01}, // home controller
-				deoj:  [3]byte{0x02, 0x88, 0x01}, // smartmeter
-				esv:   0x62,                      // get要求
-				opc:   0x01,                      // 1つ
-				edata: []EchonetliteEdata{item},
-			}
-			err := transmit(conn, elFrame.Encode())
-			if err != nil {
-				return err
-			}
-			time.Sleep(1000 * time.Millisecond)
+	} else if !slices.Contains(opts.GreetingEpcs, 0xd3) {
+		if _, err := meter.Get(ctx, 0xd3); err != nil {
+			slog.Debug("Get coefficient", "err", err)
 		}
 	}
 
 	// 今日の積算履歴を収集してみる
-	if true {
-		rqSetC := EchonetliteFrame{
-			ehd:   0x1081,
-			tid:   0x0001,
-			seoj:  [3]byte{0x05, 0xff, 0x01},                               // home controller
-			deoj:  [3]byte{0x02, 0x88, 0x01},                               // smartmeter
-			esv:   0x61,                                                    // プロパティ値書き込み要求(応答要)
-			opc:   0x01,                                                    // 1つ
-			edata: []EchonetliteEdata{{epc: 0xe5, pdc: 1, edt: []byte{0}}}, // 積算履歴収集日1(edt=0は今日)
-		}
-		rqGet := EchonetliteFrame{
-			ehd:   0x1081,
-			tid:   0x0001,
-			seoj:  [3]byte{0x05, 0xff, 0x01},       // home controller
-			deoj:  [3]byte{0x02, 0x88, 0x01},       // smartmeter
-			esv:   0x62,                            // プロパティ値読み出し要求
-			opc:   0x01,                            // 1つ
-			edata: []EchonetliteEdata{{epc: 0xe2}}, // 積算電力量計測値履歴1
-		}
-		elFrames := []EchonetliteFrame{rqSetC, rqGet}
-		for _, rq := range elFrames {
-			err = transmit(conn, rq.Encode())
-			if err != nil {
-				return err
-			}
-			time.Sleep(1000 * time.Millisecond)
-		}
+	// 積算履歴収集日1(edt=0は今日)を書き込んで、受け付けられた積算履歴収集日1と積算電力量計測値履歴1を読み出す
+	frame, err := meter.setThenGet(ctx, 0xe5, []byte{0}, 0xe5, 0xe2)
+	if err != nil {
+		return err
 	}
+	report(frame)
 
 	// 積算電力量を得る
-	err = transmit(conn, getElCumlativeWattHour())
+	frame, err = meter.Get(ctx, 0xe0)
 	if err != nil {
 		return err
 	}
-	//
-	s := "waiting"
-	for i := 0; i < 30; i++ {
-		for k := 0; k < 5; k++ {
-			fmt.Printf("%s%s\r", s, strings.Repeat(".", k))
-			time.Sleep(200 * time.Millisecond)
-		}
-		fmt.Printf("%s%s\r", s, strings.Repeat(" ", 5))
-	}
+	report(frame)
 
+	// 応答(Get_res)を待ってから次の要求を送るので待ち時間は要らない
 	for count := 0; count < 3; count++ {
 		// 瞬時電力と瞬時電流を得る
-		err := transmit(conn, getElInstantWattAmpere())
+		frame, err := meter.Get(ctx, 0xe7, 0xe8)
 		if err != nil {
 			return err
 		}
-		//
-		for i := 0; i < 30; i++ {
-			for k := 0; k < 5; k++ {
-				fmt.Printf("%s%s\r", s, strings.Repeat(".", k))
-				time.Sleep(200 * time.Millisecond)
-			}
-			fmt.Printf("%s%s\r", s, strings.Repeat(" ", 5))
-		}
-	}
-	fmt.Printf("\n")
-
-	//
-	// BルートPANA終了要求コマンドを発行する
-	//
-	_, err = CommandBRouteTerminatePana().Write(stream)
-	if err != nil {
-		return err
-	}
-	// 応答コマンドコード:0x2057, 結果コード:0x01を確認する
-	for done := false; !done; {
-		select {
-		case r := <-rxDataChan:
-			if r.Header.CommandCode == 0x2057 {
-				done = true
-				if r.Data[0] == 1 {
-					slog.Debug("CommandBRouteTerminatePana", slog.String("result", "ok"))
-				} else {
-					return fmt.Errorf("CommandBRouteTerminatePana: %#v", r)
-				}
-			}
-		case <-time.After(UartReadTimeout):
-			return ErrUartReadTimeoutExceeded
-		}
+		report(frame)
 	}
 
 	slog.Info("Bye")
@@ -665,191 +965,174 @@ func run(settingsFileName string, serialName string) error {
 	return nil
 }
 
-// 0x6028: PANA認証結果通知を処理する
-func parseNotifyPanaResult(r J11Datagram) (uint8, [8]byte) {
-	result := r.Data[0]
-	macAddress := [8]byte(r.Data[1:9])
-	return result, macAddress
-}
-
-// UDPポート0e1a(Echonet lite)に入出力する仕掛け
-type ConnEchonetlite struct {
-	stream            io.Writer
-	ipv6              netip.Addr
-	rxNotifyChan      chan J11Datagram
-	senderAddress     netip.Addr
-	senderPort        uint16
-	dstPort           uint16
-	panId             uint16
-	senderAddressType uint8
-	secure            uint8
-	rssi              int8
-	dataBytes         uint16
-	data              []byte
-}
-
-func NewConnEchonetlite(w io.Writer, address netip.Addr, rxNotify chan J11Datagram) *ConnEchonetlite {
-	return &ConnEchonetlite{stream: w, ipv6: address, rxNotifyChan: rxNotify}
-}
-
-func (c *ConnEchonetlite) Read(b []byte) (int, error) {
-	r := J11Datagram{}
-	// データ受信通知: 0x6018を確認するまでブロック
-	for r = <-c.rxNotifyChan; r.Header.CommandCode != 0x6018; {
-		slog.Debug("ignored", "rxNotify", r)
-	}
-	// Data[0,1,2,3,4,5,6,7,8,9,10,11,12,13,14,15] = 送信元IPv6 アドレス
-	// Data[16,17] = 送信元ポート番号
-	// Data[18,19] = 送信先ポート番号
-	// Data[20,21] = 送信元PAN ID
-	// Data[22] = 送信先アドレス種別
-	// Data[23] = 暗号化
-	// Data[24] = RSSI
-	// Data[25,26] = 受信データサイズ
-	// Data[27:] = 受信データ
-	c.senderAddress = netip.AddrFrom16([16]byte(r.Data[0:16]))
-	c.senderPort = binary.BigEndian.Uint16(r.Data[16:18])
-	c.dstPort = binary.BigEndian.Uint16(r.Data[18:20])
-	c.panId = binary.BigEndian.Uint16(r.Data[20:22])
-	c.senderAddressType = r.Data[22]
-	c.secure = r.Data[23]
-	c.rssi = int8(r.Data[24])
-	c.dataBytes = binary.BigEndian.Uint16(r.Data[25:27])
-	c.data = r.Data[27:]
-	senderAddressType := "N/A"
-	switch c.senderAddressType {
-	case 0x00:
-		senderAddressType = "ユニキャスト"
-	case 0x01:
-		senderAddressType = "マルチキャスト"
-	}
-	secure := "N/A"
-	switch c.secure {
-	case 0x01:
-		secure = "暗号化なし"
-	case 0x02:
-		secure = "暗号化あり"
-	}
-	slog.Debug("Received",
-		//		slog.Int("senderPort", int(c.senderPort)),
-		//		slog.Int("dstPort", int(c.dstPort)),
-		//		slog.Int("panId", int(c.panId)),
-		slog.String("senderAddressType", senderAddressType),
-		slog.String("secure", secure),
-		slog.Int("rssi", int(c.rssi)),
-		slog.Int("dataBytes", int(c.dataBytes)),
-		slog.String("data(hex)", hex.EncodeToString(c.data)),
+// 連続読み取りで期限内に読み取りに成功しなかった
+var ErrReadDeadlineExceeded = errors.New("no successful read within deadline")
+
+// 中断されるまでスマートメーターから定期的に読み取る
+// 読み取りに失敗しても記録して続けるが、シリアルポートが読めなくなったらErrSerialReadFailedを返す
+// reauthThreshold回続けてタイムアウトしたらPANAセッションの期限切れとみなしてPANA認証をやり直す
+// PANA認証をやり直せなければBルート動作開始からやり直す(Reconnect)
+// readDeadlineの間読み取りに成功しなければErrReadDeadlineExceededを返す
+func poll(ctx context.Context, meter *Meter, report func(*EchonetliteFrame), interval time.Duration, cumulativeInterval time.Duration, reauthThreshold int, readDeadline time.Duration) error {
+	var (
+		timeouts    int   // 連続タイムアウト回数
+		reauthCount int   // PANA認証をやり直した回数
+		lost        error // シリアルポートが読めなくなったらnil以外
+		deadline    <-chan time.Time
 	)
-	return copy(b, c.data), nil
-}
+	// 読み取りに成功する毎に期限を延ばす
+	var watchdog *time.Timer
+	if readDeadline > 0 {
+		watchdog = time.NewTimer(readDeadline)
+		defer watchdog.Stop()
+		deadline = watchdog.C
+	}
+	readSucceeded := func() {
+		timeouts = 0
+		if watchdog != nil {
+			watchdog.Reset(readDeadline)
+		}
+		metricRssi.Set(float64(meter.LinkQuality()))
+		daemonStatus.ReadSucceeded(time.Now(), meter.LinkQuality())
+	}
+	// 読み取り失敗を記録して、続けてタイムアウトしていたらPANA認証をやり直す
+	readFailed := func(name string, err error) {
+		// 中断されたときは失敗として数えない
+		if ctx.Err() != nil {
+			return
+		}
+		slog.Warn(name, "err", err)
+		metricReadErrors.Add(1)
+		if errors.Is(err, ErrSerialReadFailed) {
+			lost = err
+			return
+		}
+		// PANA認証をやり直せなかったときも続けてやり直す
+		if !errors.Is(err, ErrUartReadTimeoutExceeded) && !errors.Is(err, ErrNotConnected) {
+			return
+		}
+		timeouts++
+		if reauthThreshold <= 0 || timeouts < reauthThreshold {
+			return
+		}
+		timeouts = 0
+		reauthCount++
+		daemonStatus.SetReauthCount(reauthCount)
+		slog.Warn("PANA re-authentication", "count", reauthCount)
+		if err := meter.Reauthenticate(ctx); err != nil {
+			// PANA認証のやり直しで戻らなければBルート動作開始からやり直す
+			slog.Warn("Reauthenticate", "err", err, "count", reauthCount, "fallback", "reconnect")
+			if err := meter.Reconnect(ctx); err != nil {
+				slog.Error("Reconnect", "err", err, "count", reauthCount)
+				daemonStatus.SetConnected(false)
+				return
+			}
+		}
+		daemonStatus.SetConnected(true)
+	}
+	// 瞬時電力と瞬時電流を得る
+	readInstant := func() {
+		frame, err := meter.Get(ctx, 0xe7, 0xe8)
+		if err != nil {
+			readFailed("poll instant", err)
+			return
+		}
+		readSucceeded()
+		report(frame)
+		scale, scaleErr := meter.CumulativeScale()
+		updateMetrics(frame, scale, scaleErr)
+	}
+	// 積算電力量を得る
+	readCumulative := func() {
+		frame, err := meter.Get(ctx, 0xe0)
+		if err != nil {
+			readFailed("poll cumulative", err)
+			return
+		}
+		readSucceeded()
+		report(frame)
+		scale, scaleErr := meter.CumulativeScale()
+		updateMetrics(frame, scale, scaleErr)
+	}
+	// 最初の読み取り
+	// 積算電力量の換算に必要な係数、有効桁数、単位と積算電力量、瞬時電力、瞬時電流を1つの要求にまとめて
+	// 1往復で最初の計測値を得る(係数が存在しないスマートメーターでは不可応答になるが他の値は得られる)
+	readFirst := func() {
+		epcs := []byte{0xe7, 0xe8}
+		if cumulativeInterval > 0 {
+			epcs = append([]byte{0xd3, 0xd7, 0xe1, 0xe0}, epcs...)
+		}
+		frame, err := meter.Get(ctx, epcs...)
+		if err != nil {
+			readFailed("poll first", err)
+			// まとめて読めなかったときは換算に必要な値だけでも読み出しておく
+			if cumulativeInterval > 0 && ctx.Err() == nil && lost == nil {
+				if err := meter.LoadCumulativeScale(ctx); err != nil {
+					slog.Warn("LoadCumulativeScale", "err", err)
+				}
+			}
+			return
+		}
+		readSucceeded()
+		report(frame)
+		scale, scaleErr := meter.CumulativeScale()
+		updateMetrics(frame, scale, scaleErr)
+	}
 
-func (c *ConnEchonetlite) Write(b []byte) (int, error) {
-	// データ送信要求コマンドを発行する
-	j11command, err := CommandTransmitData(c.ipv6, b)
-	if err != nil {
-		return 0, err
+	instantTicker := time.NewTicker(interval)
+	defer instantTicker.Stop()
+	var cumulativeTick <-chan time.Time
+	if cumulativeInterval > 0 {
+		cumulativeTicker := time.NewTicker(cumulativeInterval)
+		defer cumulativeTicker.Stop()
+		cumulativeTick = cumulativeTicker.C
 	}
-	return j11command.Write(c.stream)
-}
+	readFirst()
 
-// UART通信読み取り
-func uartReceiver(ctx context.Context, rd io.Reader, rxData chan J11Datagram, rxNotify chan J11Datagram) {
-	for {
+	for lost == nil {
 		select {
 		case <-ctx.Done():
-			return
-		default:
-			resp, err := readJ11ProtocolDatagram(ctx, rd)
-			if err != nil {
-				slog.Error("readJ11ProtocolDatagram", "err", err)
-				continue
-			}
-			if resp == nil {
-				continue
-			}
-			if 0x2000 <= resp.Header.CommandCode && resp.Header.CommandCode <= 0x2fff {
-				rxData <- *resp // コマンド応答チャンネルへ送る
-			} else {
-				rxNotify <- *resp // 通知チャンネルへ送る
-			}
+			slog.Info("interrupted")
+			return nil
+		case <-instantTicker.C:
+			readInstant()
+		case <-cumulativeTick:
+			readCumulative()
+		case <-deadline:
+			slog.Error("no successful read", "deadline", readDeadline)
+			return fmt.Errorf("%w: %v", ErrReadDeadlineExceeded, readDeadline)
 		}
 	}
+	return lost
 }
 
-func readJ11ProtocolDatagram(ctx context.Context, rd io.Reader) (*J11Datagram, error) {
-	// d0 f9 ee 5d が検出できるまで入力を破棄し続ける
-	var preamble uint32
-	for preamble != UniqueCodeResponseCommand {
-		var b [1]byte
-		n, err := rd.Read(b[:])
-		if n == 0 || err == io.EOF { // 読み取りデータ不足
-			select {
-			case <-ctx.Done():
-				return nil, ctx.Err()
-			default:
-				continue
-			}
-		} else if err != nil {
-			return nil, err
-		}
-		preamble = preamble<<8 | uint32(b[0])
-	}
-	// ヘッダ部読み取り
-	var buf [J11DatagramHeaderBytes]byte
-	binary.BigEndian.PutUint32(buf[:], preamble)
-	for i := 4; i < J11DatagramHeaderBytes; {
-		n, err := rd.Read(buf[i:])
-		if n == 0 || err == io.EOF { // 読み取りデータ不足
-			select {
-			case <-ctx.Done():
-				return nil, ctx.Err()
-			default:
-				continue
-			}
-		} else if err != nil {
-			return nil, err
-		}
-		i += n
-	}
-	header := J11DatagramHeader{}
-	binary.Decode(buf[:], binary.BigEndian, &header)
-	// ヘッダ部チェックサム検査
-	if header.HeaderChecksum != header.CalcHeaderChecksum() {
-		slog.Debug(
-			"header checksum mismatched",
-			"checksum", header.CalcHeaderChecksum(),
-			"HeaderChecksum", header.HeaderChecksum,
-		)
-		return nil, nil
-	}
-	// データ部読み取り
-	dataBytes := header.MessageLen - 4
-	data := make([]byte, dataBytes)
-	for i := 0; i < int(dataBytes); {
-		n, err := rd.Read(data[i:])
-		if n == 0 || err == io.EOF { // 読み取りデータ不足
-			select {
-			case <-ctx.Done():
-				return nil, ctx.Err()
-			default:
-				continue
-			}
-		} else if err != nil {
-			return nil, err
-		}
-		i += n
+// ログの出力形式
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// JSON形式でログを出力するならtrue
+// 計測値を文字列にせず数値のままログに出す
+var structuredLog bool
+
+// ログレベル(debug/info/warn/error)と出力形式(text/json)を指定してslogの既定のロガーを設定する
+func setupLogger(w io.Writer, level string, format string) error {
+	var lv slog.Level
+	if err := lv.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("unknown log level: %s", level)
 	}
-	// データ部チェックサム検査
-	if header.DataChecksum != CalcChecksum(data) {
-		slog.Debug(
-			"data checksum mismatched",
-			"checksum", CalcChecksum(data),
-			"DataChecksum", header.DataChecksum,
-		)
-		return nil, nil
+	opts := &slog.HandlerOptions{Level: lv}
+	switch format {
+	case LogFormatText:
+		slog.SetDefault(slog.New(slog.NewTextHandler(w, opts)))
+	case LogFormatJSON:
+		slog.SetDefault(slog.New(slog.NewJSONHandler(w, opts)))
+	default:
+		return fmt.Errorf("unknown log format: %s", format)
 	}
-
-	return &J11Datagram{Header: header, Data: data}, nil
+	structuredLog = format == LogFormatJSON
+	return nil
 }
 
 func main() {
@@ -858,7 +1141,16 @@ func main() {
 		serialDevice     string
 		rbid             RouteBId
 		rbpassword       RouteBPassword
+		passwordFile     string
+		omitPassword     bool
+		macAddress       uint64
 		scanDuration     int
+		scanRetries      int
+		channelMask      uint32 = DefaultScanChannelMask
+		timeout          time.Duration
+		runOptions       RunOptions
+		logLevel         string
+		logFormat        string
 	)
 	app := &cli.App{
 		Name:    "BRouteJ11",
@@ -868,16 +1160,85 @@ func main() {
 			&cli.StringFlag{
 				Name:        "settings",
 				Aliases:     []string{"S"},
-				Usage:       "設定ファイル名",
+				Usage:       "設定ファイル名(\"-\"なら環境変数" + SettingsEnv + "または標準入力から読み、書き込まない)",
 				Destination: &settingsFileName,
 				Value:       "settings.json",
 			},
 			&cli.StringFlag{
 				Name:        "device",
 				Aliases:     []string{"D"},
-				Usage:       "シリアルデバイス名",
+				Usage:       "シリアルデバイス名(例: /dev/ttyUSB0, COM3)",
 				Destination: &serialDevice,
-				Value:       "/dev/ttyUSB0",
+				Value:       DefaultSerialDevice,
+			},
+			&cli.DurationFlag{
+				Name:        "timeout",
+				Usage:       "UART読み取りタイムアウト値(例: 90s) 未指定なら設定ファイルの値または90s",
+				Destination: &timeout,
+			},
+			&cli.IntFlag{
+				Name:  "baud",
+				Usage: "シリアルポートのボーレート 未指定なら設定ファイルの値または115200",
+				Action: func(ctx *cli.Context, v int) error {
+					if err := validateBaud(v); err != nil {
+						return err
+					}
+					SerialBaud = v
+					return nil
+				},
+			},
+			&cli.IntFlag{
+				Name:        "open-retry",
+				Usage:       "シリアルデバイスを開けなかったときにやり直す回数",
+				Destination: &SerialOpenRetry.Count,
+				Value:       SerialOpenRetry.Count,
+			},
+			&cli.DurationFlag{
+				Name:        "open-backoff",
+				Usage:       "シリアルデバイスを開き直すまでの最初の待ち時間(やり直す毎に倍になる)",
+				Destination: &SerialOpenRetry.Backoff,
+				Value:       SerialOpenRetry.Backoff,
+			},
+			&cli.UintFlag{
+				Name:  "tx-power",
+				Usage: "アダプタの送信電力(0: 20mW, 1: 10mW, 2: 1mW)",
+				Value: uint(InitialSetup.TxPower),
+				Action: func(ctx *cli.Context, v uint) error {
+					if v > 0x02 {
+						return fmt.Errorf("tx-power %d is out of range(0～2)", v)
+					}
+					InitialSetup.TxPower = uint8(v)
+					return nil
+				},
+			},
+			&cli.StringFlag{
+				Name:  "capture-file",
+				Usage: "送受信したechonet lite電文を日時付きの16進数文字列でファイルに追記する(decodeで解釈できる)",
+				Action: func(ctx *cli.Context, v string) error {
+					f, err := os.OpenFile(v, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+					if err != nil {
+						return err
+					}
+					Capture = NewFrameCapture(f)
+					return nil
+				},
+			},
+			&cli.BoolFlag{
+				Name:        "han-sleep",
+				Usage:       "アダプタのHAN Sleep機能を有効にする",
+				Destination: &InitialSetup.HanSleep,
+			},
+			&cli.StringFlag{
+				Name:        "log-level",
+				Usage:       "ログレベル(debug, info, warn, error)",
+				Destination: &logLevel,
+				Value:       "info",
+			},
+			&cli.StringFlag{
+				Name:        "log-format",
+				Usage:       "ログの出力形式(text, json)",
+				Destination: &logFormat,
+				Value:       LogFormatText,
 			},
 		},
 		Commands: []*cli.Command{
@@ -890,40 +1251,186 @@ func main() {
 						Aliases:     []string{"T"},
 						Usage:       "アクティブスキャン時間(1～14)",
 						Destination: &scanDuration,
-						Value:       7,
+						Value:       int(DefaultScanDuration),
+					},
+					&cli.IntFlag{
+						Name:        "scan-retry",
+						Usage:       "スマートメーターが見つからなかったときにスキャン時間を延ばしてやり直す回数",
+						Destination: &scanRetries,
+						Value:       DefaultScanRetries,
+					},
+					&cli.StringFlag{
+						Name:  "channels",
+						Usage: "スキャンするチャネル(4～17) カンマ区切りまたは範囲で指定する(例: 4,5,6 または 4-17)",
+						Value: "4-17",
+						Action: func(ctx *cli.Context, s string) error {
+							channels, err := parseChannels(s)
+							if err != nil {
+								return err
+							}
+							channelMask, err = ScanChannelMask(channels)
+							return err
+						},
 					},
 					&cli.StringFlag{
 						Name:    "id",
 						Aliases: []string{"Id"},
 						Usage:   "ルートBID(32文字)",
-						Action: func(ctx *cli.Context, s string) error {
-							bytes := []byte(s)
-							if len(bytes) != 32 {
-								return fmt.Errorf("ルートＢＩＤは32文字です")
-							}
-							rbid = [32]byte(bytes)
-							return nil
+						Action: func(ctx *cli.Context, s string) (err error) {
+							rbid, err = ParseRouteBId(s)
+							return err
 						},
 					},
 					&cli.StringFlag{
 						Name:    "password",
 						Aliases: []string{"Pwd"},
 						Usage:   "ルートBパスワード(12文字)",
-						Action: func(ctx *cli.Context, s string) error {
-							bytes := []byte(s)
-							if len(bytes) != 12 {
-								return fmt.Errorf("ルートＢパスワードは12文字です")
-							}
-							rbpassword = [12]byte(bytes)
-							return nil
+						EnvVars: []string{RouteBPasswordEnv},
+						Action: func(ctx *cli.Context, s string) (err error) {
+							rbpassword, err = ParseRouteBPassword(s)
+							return err
+						},
+					},
+					&cli.StringFlag{
+						Name:        "password-file",
+						Usage:       "ルートBパスワードを書いたファイル(設定ファイルにはパスワードの代わりにこのファイル名を保存する)",
+						Destination: &passwordFile,
+					},
+					&cli.StringFlag{
+						Name:  "mac",
+						Usage: "複数のスマートメーターが応答したときに選ぶMACアドレス(16進数16桁)",
+						Action: func(ctx *cli.Context, s string) (err error) {
+							macAddress, err = parseMacAddress(s)
+							return err
 						},
 					},
+					&cli.BoolFlag{
+						Name:        "omit-password",
+						Usage:       "設定ファイルにルートBパスワードを保存しない(実行時に環境変数" + RouteBPasswordEnv + "で渡す)",
+						Destination: &omitPassword,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					if err := setupLogger(os.Stdout, logLevel, logFormat); err != nil {
+						return err
+					}
+					if passwordFile != "" {
+						password, err := readPasswordFile(passwordFile)
+						if err != nil {
+							return err
+						}
+						rbpassword, err = ParseRouteBPassword(password)
+						if err != nil {
+							return err
+						}
+						// 実行時の作業ディレクトリに依らないように絶対パスで保存する
+						passwordFile, err = filepath.Abs(passwordFile)
+						if err != nil {
+							return err
+						}
+					}
+					if rbpassword == (RouteBPassword{}) {
+						return errors.New("ルートＢパスワードを--password, --password-fileまたは環境変数" + RouteBPasswordEnv + "で指定してください")
+					}
+					err := pairing(settingsFileName, serialDevice, uint8(scanDuration), channelMask, scanRetries, rbid, rbpassword, passwordFile, omitPassword, macAddress, timeout)
+					if err != nil {
+						return err
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "firmware",
+				Usage: "アダプタのファームウェアバージョンを表示する",
+				Action: func(c *cli.Context) error {
+					if err := setupLogger(os.Stdout, logLevel, logFormat); err != nil {
+						return err
+					}
+					err := firmware(serialDevice, timeout)
+					if err != nil {
+						return err
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "selftest",
+				Usage: "アダプタと通信できるか確かめる(ルートB認証情報は要らない)",
+				Action: func(c *cli.Context) error {
+					if err := setupLogger(os.Stdout, logLevel, logFormat); err != nil {
+						return err
+					}
+					return selftest(os.Stdout, serialDevice, timeout)
+				},
+			},
+			{
+				Name:  "ports",
+				Usage: "--deviceに指定できるシリアルデバイスを表示する",
+				Action: func(c *cli.Context) error {
+					return ports(os.Stdout)
+				},
+			},
+			{
+				Name:  "discover",
+				Usage: "スマートメーターが持つインスタンスを表示する",
+				Action: func(c *cli.Context) error {
+					if err := setupLogger(os.Stdout, logLevel, logFormat); err != nil {
+						return err
+					}
+					err := discover(settingsFileName, serialDevice, timeout)
+					if err != nil {
+						return err
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "get",
+				Usage: "任意のオブジェクトの任意のプロパティ値を読み出す",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "eoj",
+						Usage: "読み出すオブジェクト(16進数6桁)",
+						Value: "028801",
+					},
+					&cli.StringSliceFlag{
+						Name:     "epc",
+						Usage:    "読み出すプロパティ(16進数2桁 複数指定可)",
+						Required: true,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					deoj, err := parseEoj(c.String("eoj"))
+					if err != nil {
+						return err
+					}
+					var epcs []byte
+					for _, v := range c.StringSlice("epc") {
+						epc, err := parseEpc(v)
+						if err != nil {
+							return err
+						}
+						epcs = append(epcs, epc)
+					}
+					if err := setupLogger(os.Stdout, logLevel, logFormat); err != nil {
+						return err
+					}
+					err = get(settingsFileName, serialDevice, timeout, deoj, epcs)
+					if err != nil {
+						return err
+					}
+					return nil
 				},
+			},
+			{
+				Name:      "decode",
+				Usage:     "16進数文字列のechonet lite電文を解釈して表示する(スマートメーターに接続しない)",
+				ArgsUsage: "[電文の16進数文字列]",
 				Action: func(c *cli.Context) error {
-					slog.SetDefault(
-						slog.New(
-							slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug})))
-					err := pairing(settingsFileName, serialDevice, uint8(scanDuration), rbid, rbpassword)
+					if err := setupLogger(os.Stdout, logLevel, logFormat); err != nil {
+						return err
+					}
+					err := decode(strings.Join(c.Args().Slice(), ""), os.Stdin)
 					if err != nil {
 						return err
 					}
@@ -933,12 +1440,113 @@ func main() {
 			{
 				Name:  "run",
 				Usage: "スマートメータから電力消費量を得る",
-				Flags: []cli.Flag{},
+				Flags: []cli.Flag{
+					&cli.DurationFlag{
+						Name:        "interval",
+						Usage:       "瞬時電力と瞬時電流を読み取る間隔(例: 60s) 指定すると中断されるまで読み取り続ける(デーモン動作)",
+						Destination: &runOptions.Interval,
+					},
+					&cli.BoolFlag{
+						Name:        "once",
+						Usage:       "1回読み取って終了する(--intervalを指定しないときの既定の動作)",
+						Destination: &runOptions.Once,
+					},
+					&cli.DurationFlag{
+						Name:        "cumulative-interval",
+						Usage:       "連続読み取り時に積算電力量を読み取る間隔(0なら読み取らない)",
+						Destination: &runOptions.CumulativeInterval,
+						Value:       10 * time.Minute,
+					},
+					&cli.IntFlag{
+						Name:        "retry",
+						Usage:       "データ送信に失敗したときの再送回数",
+						Destination: &runOptions.Retry.Count,
+						Value:       DefaultRetryPolicy.Count,
+					},
+					&cli.DurationFlag{
+						Name:        "retry-backoff",
+						Usage:       "最初の再送までの待ち時間(再送する毎に倍になる)",
+						Destination: &runOptions.Retry.Backoff,
+						Value:       DefaultRetryPolicy.Backoff,
+					},
+					&cli.StringFlag{
+						Name:  "mac",
+						Usage: "設定ファイルの代わりに接続するスマートメーターのMACアドレス(16進数16桁)",
+						Action: func(ctx *cli.Context, s string) (err error) {
+							runOptions.MacAddress, err = parseMacAddress(s)
+							return err
+						},
+					},
+					&cli.StringSliceFlag{
+						Name:  "greeting",
+						Usage: "1回読み取るときに最初に読み出すプロパティ(16進数2桁 複数指定可 noneなら読み出さない) 未指定ならd7,e1,ea",
+					},
+					&cli.BoolFlag{
+						Name:        "auto-repair",
+						Usage:       "続けて接続に失敗したら設定ファイルの認証情報でpairingをやり直して設定ファイルを更新する",
+						Destination: &runOptions.AutoRepair,
+					},
+					&cli.IntFlag{
+						Name:        "reauth-after",
+						Usage:       "連続読み取り時にこの回数続けてタイムアウトしたらPANA認証をやり直す(0ならやり直さない)",
+						Destination: &runOptions.ReauthThreshold,
+						Value:       3,
+					},
+					&cli.DurationFlag{
+						Name:        "read-deadline",
+						Usage:       "連続読み取り時にこの時間読み取りに成功しなければ0以外の終了コードで終了する(例: 10m 0なら終了しない)",
+						Destination: &runOptions.ReadDeadline,
+					},
+					&cli.StringFlag{
+						Name:        "metrics-addr",
+						Usage:       "連続読み取り時に計測値をPrometheus形式で公開するアドレス(例: :9100)",
+						Destination: &runOptions.MetricsAddr,
+					},
+					&cli.StringFlag{
+						Name:        "output",
+						Aliases:     []string{"o"},
+						Usage:       "出力形式(text: ログとして表示, json: 1行に1つのJSONで標準出力に出力)",
+						Destination: &runOptions.Output,
+						Value:       OutputText,
+					},
+					&cli.StringSliceFlag{
+						Name:  "sink",
+						Usage: "計測値の出力先(json, csv: 標準出力, json:FILE, csv:FILE: ファイルに追記 複数指定可)",
+					},
+				},
 				Action: func(c *cli.Context) error {
-					slog.SetDefault(
-						slog.New(
-							slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug})))
-					err := run(settingsFileName, serialDevice)
+					runOptions.GreetingEpcs = DefaultGreetingEpcs
+					if c.IsSet("greeting") {
+						runOptions.GreetingEpcs = nil
+						for _, v := range c.StringSlice("greeting") {
+							if v == "none" {
+								continue
+							}
+							epc, err := parseEpc(v)
+							if err != nil {
+								return err
+							}
+							runOptions.GreetingEpcs = append(runOptions.GreetingEpcs, epc)
+						}
+					}
+					sink, closeSinks, sinkToStdout, err := openSinks(c.StringSlice("sink"))
+					if err != nil {
+						return err
+					}
+					defer closeSinks()
+					if len(sink) > 0 {
+						runOptions.Sink = sink
+					}
+					// JSONなどを出力する場合は標準出力を汚さないようにログを標準エラー出力に出す
+					logOutput := os.Stdout
+					if runOptions.Output == OutputJSON || sinkToStdout {
+						logOutput = os.Stderr
+					}
+					if err := setupLogger(logOutput, logLevel, logFormat); err != nil {
+						return err
+					}
+					runOptions.Timeout = timeout
+					err = run(settingsFileName, serialDevice, runOptions)
 					if err != nil {
 						return err
 					}
@@ -948,8 +1556,13 @@ func main() {
 		},
 	}
 
-	if err := app.Run(os.Args); err != nil {
+	err := app.Run(os.Args)
+	// os.Exitの前に--capture-fileのファイルを閉じる
+	if err := Capture.Close(); err != nil {
+		slog.Warn("capture", "err", err)
+	}
+	if err != nil {
 		slog.Error("app.Run", "err", err)
-		return
+		os.Exit(1)
 	}
 }
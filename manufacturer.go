@@ -0,0 +1,26 @@
+// BP35Cx-J11を使ってスマートメータから電力消費量などを得る
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 Akihiro Yamamoto <github.com/ak1211>
+package main
+
+import "encoding/hex"
+
+// ECHONETコンソーシアムが割り当てたメーカーコード(0x8a)と会社名
+// 知られているものだけ 必要に応じて追加する
+var manufacturerNames = map[[3]byte]string{
+	{0x00, 0x00, 0x05}: "シャープ",
+	{0x00, 0x00, 0x06}: "三菱電機",
+	{0x00, 0x00, 0x08}: "ダイキン工業",
+	{0x00, 0x00, 0x0b}: "パナソニック",
+	{0x00, 0x00, 0x16}: "東芝",
+}
+
+// メーカーコードを"会社名 (hex)"の形式にする
+// 表に無ければhexだけにする
+func ManufacturerName(code [3]byte) string {
+	s := hex.EncodeToString(code[:])
+	if name, ok := manufacturerNames[code]; ok {
+		return name + " (" + s + ")"
+	}
+	return s
+}
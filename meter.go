@@ -0,0 +1,1638 @@
+// BP35Cx-J11を使ってスマートメータから電力消費量などを得る
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 Akihiro Yamamoto <github.com/ak1211>
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/bits"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BP35Cx-J11を介してスマートメーターと通信する
+type Meter struct {
+	stream         SerialPort
+	routeBId       RouteBId
+	routeBPassword RouteBPassword
+	channel        uint8
+	macAddress     uint64
+	panId          uint16
+	// Connect時にアクティブスキャンで探し直したスマートメーター
+	rescanned *BeaconResponse
+	// trueなら探し直すときに他のスマートメーターを選ばない
+	pinned bool
+	// 最後に受信したときのRSSI(受信ゴルーチンから更新する)
+	rssi atomic.Int32
+	// 待ち時間を計る時計(記録したセッションを再生するときに差し替える)
+	after func(time.Duration) <-chan time.Time
+	// UART読み取りタイムアウト値
+	timeout time.Duration
+	// データ送信失敗時の再送方針
+	retryPolicy RetryPolicy
+	// 初期設定要求コマンドのチャネル以外の設定
+	setupOptions InitialSetupOptions
+	// 送受信したechonet lite電文の記録先(nilなら記録しない)
+	capture *FrameCapture
+	// コマンド応答を届ける仕掛け
+	router *ResponseRouter
+	// 通知チャネル
+	rxNotifyChan chan J11Datagram
+	// 受信したechonet lite電文のチャネル(要求に対する応答など通知以外)
+	rxFrameChan chan *EchonetliteFrame
+	// 通知(INF, INFC)で受け取ったインスタンスリスト(0xd5)を含む電文のチャネル
+	rxInstanceListChan chan *EchonetliteFrame
+	// 通知(INF, INFC)を受け取る関数(nilならShowで表示する)
+	notifyHandler func(*EchonetliteFrame)
+	conn          *ConnEchonetlite
+	// Bルート動作中ならtrue
+	bRouteStarted bool
+	// オープンしたUDPポート(0ならオープンしていない)
+	udpPort uint16
+	// オープンするUDPポートとスマートメーターのUDPポート
+	localPort  uint16
+	remotePort uint16
+	// 通知(INF, INFC)を出力する受信ゴルーチンからも使うので、
+	// 換算と前回の積算電力量計測値はcumulativeMuで守る
+	cumulativeMu sync.Mutex
+	// 最後に受信した積算電力量計測値の換算
+	scale CumulativeScale
+	// 積算電力量単位(0xe1)が未取得または規定外ならエラー
+	scaleErr error
+	// 増分を計算するために覚えておく前回の積算電力量計測値と計測日時
+	prevCumulative   uint64
+	prevCumulativeAt time.Time
+	// PANAセッション確立後に通知されたインスタンスリスト
+	instances [][3]byte
+	// 最後に成功したデータ送信要求応答
+	lastTransmit TransmitResult
+	// 最後に送信したechonet lite電文のトランザクションID
+	tid    uint16
+	cancel context.CancelFunc
+	// uartReceiverが終了したら閉じる
+	receiverDone chan struct{}
+	// uartReceiverが終了した理由(receiverDoneが閉じてから読む)
+	receiverErr error
+}
+
+// Closeで終了処理にかける時間の上限
+// アダプタが応答しなくなっていても終了できるようにする
+const ShutdownTimeout = 10 * time.Second
+
+// ハードウェアリセット要求をやり直すまでに起動完了通知を待つ時間
+const ResetRetryTimeout = 3 * time.Second
+
+// データ送信失敗時の再送方針
+type RetryPolicy struct {
+	// 再送回数(0なら再送しない)
+	Count int
+	// 最初の再送までの待ち時間(再送する毎に倍になる)
+	Backoff time.Duration
+}
+
+// 再送方針の既定値
+var DefaultRetryPolicy = RetryPolicy{Count: 3, Backoff: 2 * time.Second}
+
+// 設定からMeterを作る
+// ペアリング前はMacAddressが空でも良い
+// アダプタだけを操作するならRouteBId,RouteBPasswordも空でも良い
+func NewMeter(stream SerialPort, settings Settings) (*Meter, error) {
+	var (
+		routeBId       RouteBId
+		routeBPassword RouteBPassword
+	)
+	if settings.RouteBId != "" {
+		var err error
+		routeBId, err = ParseRouteBId(settings.RouteBId)
+		if err != nil {
+			return nil, fmt.Errorf("RouteBId: %w", err)
+		}
+	}
+	if settings.RouteBPassword != "" {
+		var err error
+		routeBPassword, err = ParseRouteBPassword(settings.RouteBPassword)
+		if err != nil {
+			return nil, fmt.Errorf("RouteBPassword: %w", err)
+		}
+	}
+	var macAddress uint64
+	if settings.MacAddress != "" {
+		var err error
+		macAddress, err = strconv.ParseUint(settings.MacAddress, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+	timeout := DefaultUartReadTimeout
+	if settings.UartReadTimeout != "" {
+		var err error
+		timeout, err = time.ParseDuration(settings.UartReadTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("UartReadTimeout: %w", err)
+		}
+		if timeout <= 0 {
+			return nil, fmt.Errorf("UartReadTimeout must be positive: %v", timeout)
+		}
+	}
+	localPort, err := udpPortOf("UdpPort", settings.UdpPort)
+	if err != nil {
+		return nil, err
+	}
+	remotePort, err := udpPortOf("MeterUdpPort", settings.MeterUdpPort)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &Meter{
+		stream:             stream,
+		routeBId:           routeBId,
+		routeBPassword:     routeBPassword,
+		channel:            uint8(settings.Channel),
+		macAddress:         macAddress,
+		panId:              uint16(settings.PanId),
+		timeout:            timeout,
+		retryPolicy:        DefaultRetryPolicy,
+		setupOptions:       InitialSetup,
+		capture:            Capture,
+		localPort:          localPort,
+		remotePort:         remotePort,
+		scale:              CumulativeScale{Coefficient: 1},
+		scaleErr:           errors.New("積算電力量単位(0xe1)が未取得"),
+		router:             NewResponseRouter(),
+		after:              time.After,
+		rxNotifyChan:       make(chan J11Datagram, 64),
+		rxFrameChan:        make(chan *EchonetliteFrame, 64),
+		rxInstanceListChan: make(chan *EchonetliteFrame, 1),
+		cancel:             cancel,
+		receiverDone:       make(chan struct{}),
+	}
+	go func() {
+		defer close(m.receiverDone)
+		m.receiverErr = uartReceiver(ctx, stream, m.router, m.rxNotifyChan)
+	}()
+	return m, nil
+}
+
+// 設定ファイルのUDPポート番号を検査する(0ならEchonetLitePort)
+func udpPortOf(name string, port int) (uint16, error) {
+	switch {
+	case port == 0:
+		return EchonetLitePort, nil
+	case 1 <= port && port <= 0xffff:
+		return uint16(port), nil
+	default:
+		return 0, fmt.Errorf("%s %d is out of range(1～65535)", name, port)
+	}
+}
+
+// データ送信失敗時の再送方針を設定する
+func (m *Meter) SetRetryPolicy(policy RetryPolicy) {
+	m.retryPolicy = policy
+}
+
+// PANA認証に失敗した
+var ErrPanaAuthFailed = errors.New("PANA auth failed")
+
+// PANA認証でスマートメーターから応答が無かった
+var ErrPanaNoResponse = errors.New("no response to smart meter")
+
+// ハードウェアリセットしても起動完了通知が無かった
+var ErrHardwareResetNoResponse = errors.New("J11 UART hardware reset command has no response")
+
+// 受信したデータが壊れていた(そのデータを捨てれば受信は続けられる)
+var ErrMalformedData = errors.New("malformed data")
+
+// ルートB認証IDとパスワードが無い
+var ErrCredentialsRequired = errors.New("RouteBId and RouteBPassword are required")
+
+// PANAセッションが無いのでデータを送信できない
+var ErrNotConnected = errors.New("not connected")
+
+// スマートメーターに接続してPANA認証を行う
+//
+// 設定のチャネルとMACアドレスでBルート動作開始とPANA認証を試みる。
+// 認証に失敗したり応答が無かったときはスマートメーターが変わったとみなして
+// アクティブスキャンで探し直し、見つかったスマートメーターでもう一度だけ試みる。
+// 探し直した結果はRescanned()で得られる。
+func (m *Meter) Connect(ctx context.Context) error {
+	err := m.reset(ctx)
+	if err != nil {
+		return err
+	}
+	if version, err := m.GetFirmwareVersion(ctx); err != nil {
+		slog.Warn("GetFirmwareVersion", "err", err)
+	} else {
+		slog.Info("J11", slog.String("firmware", version))
+	}
+	err = m.setup(ctx)
+	if err != nil {
+		return err
+	}
+	err = m.startSession(ctx)
+	if errors.Is(err, ErrPanaAuthFailed) || errors.Is(err, ErrPanaNoResponse) {
+		slog.Warn("Connect", "err", err, "fallback", "active scan")
+		return m.rescan(ctx)
+	}
+	return err
+}
+
+// 接続済みのPANAセッションを張り直す
+//
+// アダプタの初期設定は済んでいるのでリセットせずにBルート動作開始とPANA認証だけをやり直す。
+// 認証に失敗したときはConnectと同じくアクティブスキャンで探し直す。
+func (m *Meter) Reconnect(ctx context.Context) error {
+	if err := m.terminate(ctx); err != nil {
+		slog.Warn("terminate", "err", err)
+	}
+	err := m.startSession(ctx)
+	if errors.Is(err, ErrPanaAuthFailed) || errors.Is(err, ErrPanaNoResponse) {
+		slog.Warn("Reconnect", "err", err, "fallback", "active scan")
+		return m.rescan(ctx)
+	}
+	return err
+}
+
+// 探し直すときも設定のMACアドレスのスマートメーターだけを選ぶようにする
+// 近所のスマートメーターが見える場所で他のスマートメーターに接続しないようにする
+func (m *Meter) PinMacAddress() {
+	m.pinned = true
+}
+
+// Connect時にアクティブスキャンで探し直していたら見つかったスマートメーターを返す
+func (m *Meter) Rescanned() (BeaconResponse, bool) {
+	if m.rescanned == nil {
+		return BeaconResponse{}, false
+	}
+	return *m.rescanned, true
+}
+
+// アクティブスキャンでスマートメーターを探し直してPANA認証を行う
+func (m *Meter) rescan(ctx context.Context) error {
+	if err := m.terminate(ctx); err != nil {
+		slog.Warn("terminate", "err", err)
+	}
+	beacons, err := m.ActiveScan(ctx, DefaultScanDuration, DefaultScanChannelMask, DefaultScanRetries)
+	if err != nil {
+		return err
+	}
+	// 以前と同じスマートメーターが見つかればそれを、無ければRSSIの一番強いものを選ぶ
+	found, err := SelectBeacon(beacons, m.macAddress)
+	if err != nil && !m.pinned {
+		found, err = SelectBeacon(beacons, 0)
+	}
+	if err != nil {
+		return err
+	}
+	m.channel = found.channel
+	m.macAddress = found.macAddress
+	m.panId = found.panId
+	m.rescanned = &found
+	// 見つかったチャネルで初期設定をやり直す
+	if err := m.reset(ctx); err != nil {
+		return err
+	}
+	if err := m.setup(ctx); err != nil {
+		return err
+	}
+	return m.startSession(ctx)
+}
+
+// Bルート動作を開始してPANA認証を行い、Echonet liteの送受信を始める
+func (m *Meter) startSession(ctx context.Context) error {
+	//
+	// Bルート動作開始要求コマンドを発行する
+	//
+	// 応答コマンドコード:0x2053, 結果コード:0x01を確認する
+	r, err := m.command(ctx, "CommandBRouteStart", CommandBRouteStart())
+	if err != nil {
+		return err
+	}
+	m.bRouteStarted = true
+	// channel,panid,macaddressは設定ファイルにあるので表示しない
+	if len(r.Data) >= 13 {
+		var rssi int8 = int8(r.Data[12])
+		m.rssi.Store(int32(rssi))
+		slog.Debug("CommandBRouteStart", slog.String("result", "ok"), slog.Int("rssi", int(rssi)))
+	}
+
+	//
+	// UDPポートオープン要求コマンドを発行する
+	//
+	// 応答コマンドコード:0x2005, 結果コード:0x01を確認する
+	if _, err := m.command(ctx, "CommandUdpPortOpen", CommandUdpPortOpen(m.localPort)); err != nil {
+		return err
+	}
+	m.udpPort = m.localPort
+
+	return m.startPana(ctx)
+}
+
+// PANAセッションを張り直す
+// 長時間動かしているとPANAセッションの有効期限が切れて応答が無くなるので、
+// PANAセッションを終了してからPANA認証をやり直す
+func (m *Meter) Reauthenticate(ctx context.Context) error {
+	if m.conn != nil {
+		m.conn.Close()
+		m.conn = nil
+		// 応答コマンドコード:0x2057, 結果コード:0x01を確認する
+		if _, err := m.command(ctx, "CommandBRouteTerminatePana", CommandBRouteTerminatePana()); err != nil {
+			// 期限切れのセッションは終了できないことがあるので続ける
+			slog.Warn("CommandBRouteTerminatePana", "err", err)
+		}
+	}
+	return m.startPana(ctx)
+}
+
+// PANA認証を行い、Echonet liteの送受信を始める
+func (m *Meter) startPana(ctx context.Context) error {
+	// 前のセッションで受け取ったインスタンスリスト通知を捨てる
+	select {
+	case <-m.rxInstanceListChan:
+	default:
+	}
+	//
+	// BルートPANA開始要求コマンドを発行する
+	//
+	// 応答コマンドコード:0x2056, 結果コード:0x01を確認する
+	if _, err := m.command(ctx, "CommandBRouteStartPana", CommandBRouteStartPana()); err != nil {
+		return err
+	}
+	// 0x6028: PANA認証結果通知を確認するまで待つ
+	r, err := m.waitNotify(ctx, 0x6028)
+	if err != nil {
+		return err
+	}
+	result, _ := parseNotifyPanaResult(r) // macAddressは設定ファイルにあるので、表示しない
+	switch result {
+	case 1: // 認証成功
+		slog.Info("connection successful")
+	case 2: // 認証失敗
+		return ErrPanaAuthFailed
+	case 3: // 応答なし
+		return ErrPanaNoResponse
+	default: // 規定の無いコード
+		return fmt.Errorf("%w:%v", ErrPanaAuthFailed, result)
+	}
+
+	m.conn = NewConnEchonetlite(m.stream, LinkLocalFromMac(m.macAddress), m.udpPort, m.remotePort, m.rxNotifyChan)
+	m.conn.capture = m.capture
+	m.conn.receiverDone = m.receiverDone
+	go m.receiver(ctx, m.conn)
+
+	// PANAセッション確立後のインスタンスリスト通知が送られてくるまで待つ
+	select {
+	case frame := <-m.rxInstanceListChan:
+		for _, edata := range frame.edata {
+			if edata.epc == 0xd5 {
+				if v, err := edata.Value(); err == nil {
+					m.instances = v.([][3]byte)
+				}
+			}
+		}
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-m.after(m.timeout):
+		slog.Warn("no instance list notification")
+	}
+	return nil
+}
+
+// MACアドレスからIPv6リンクローカルアドレスへ変換する
+// MACアドレスの最初の1バイト下位2bit目(U/Lビット)を反転して
+// 0xFE80000000000000XXXXXXXXXXXXXXXXのXXをMACアドレスに置き換える
+// 例: 001d129012345678 → fe80::21d:1290:1234:5678
+func LinkLocalFromMac(mac uint64) netip.Addr {
+	address16 := [16]byte{}
+	binary.BigEndian.PutUint64(address16[0:8], 0xFE80_0000_0000_0000)
+	binary.BigEndian.PutUint64(address16[8:16], mac^0x0200_0000_0000_0000)
+	return netip.AddrFrom16(address16)
+}
+
+// 最後に受信したときのRSSI(dBm)
+// Bルート動作開始要求応答とデータ受信通知(0x6018)で更新する
+func (m *Meter) LinkQuality() int8 {
+	return int8(m.rssi.Load())
+}
+
+// 接続を終了する
+// PANAセッションの終了、UDPポートのクローズ、Bルート動作の終了をしてからシリアルポートを閉じる
+func (m *Meter) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	// PANA終了などのコマンド応答はuartReceiverが受け取るので、止める前に送る
+	err := m.terminate(ctx)
+	if err != nil {
+		slog.Warn("terminate", "err", err)
+	}
+	// uartReceiverを止めてからシリアルポートを閉じる(閉じると読み取り中のReadが戻る)
+	m.cancel()
+	err = errors.Join(err, m.stream.Close())
+	select {
+	case <-m.receiverDone:
+	case <-ctx.Done():
+		slog.Warn("uartReceiver did not stop in time")
+	}
+	// 届けられなかった通知と電文を捨てる
+	discarded := 0
+	for {
+		select {
+		case <-m.rxNotifyChan:
+			discarded++
+			continue
+		case <-m.rxFrameChan:
+			discarded++
+			continue
+		default:
+		}
+		break
+	}
+	if discarded > 0 {
+		slog.Debug("discarded undelivered data", "count", discarded)
+	}
+	return err
+}
+
+// PANAセッションを終了してUDPポートをクローズし、Bルート動作を終了する
+func (m *Meter) terminate(ctx context.Context) error {
+	if m.conn != nil {
+		m.conn.Close()
+		m.conn = nil
+		//
+		// BルートPANA終了要求コマンドを発行する
+		//
+		// 応答コマンドコード:0x2057, 結果コード:0x01を確認する
+		if _, err := m.command(ctx, "CommandBRouteTerminatePana", CommandBRouteTerminatePana()); err != nil {
+			return err
+		}
+	}
+	if m.udpPort != 0 {
+		port := m.udpPort
+		m.udpPort = 0
+		//
+		// UDPポートクローズ要求コマンドを発行する
+		//
+		// 応答コマンドコード:0x2006, 結果コード:0x01を確認する
+		if _, err := m.command(ctx, "CommandUdpPortClose", CommandUdpPortClose(port)); err != nil {
+			return err
+		}
+	}
+	if m.bRouteStarted {
+		m.bRouteStarted = false
+		//
+		// Bルート動作終了要求コマンドを発行する
+		//
+		// 応答コマンドコード:0x2058, 結果コード:0x01を確認する
+		if _, err := m.command(ctx, "CommandBRouteTerminate", CommandBRouteTerminate()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// スマートメーターのプロパティ値を読み出す
+func (m *Meter) Get(ctx context.Context, epcs ...byte) (*EchonetliteFrame, error) {
+	return m.GetFrom(ctx, EojSmartmeter, epcs...)
+}
+
+// 指定のオブジェクトのプロパティ値を読み出す
+func (m *Meter) GetFrom(ctx context.Context, deoj [3]byte, epcs ...byte) (*EchonetliteFrame, error) {
+	var edata []EchonetliteEdata
+	for _, epc := range epcs {
+		edata = append(edata, EchonetliteEdata{epc: epc})
+	}
+	return m.request(ctx, EchonetliteFrame{
+		ehd:   0x1081,
+		seoj:  EojHomeController,
+		deoj:  deoj,
+		esv:   0x62, // get要求
+		opc:   byte(len(edata)),
+		edata: edata,
+	})
+}
+
+// スマートメーターの複数のプロパティ値を1つのGet要求で読み出してEPC毎のEDTにする
+// 不可応答(Get_SNA)で拒否されたEPCは結果に含まない
+func (m *Meter) GetProperties(ctx context.Context, epcs []byte) (map[byte][]byte, error) {
+	frame, err := m.Get(ctx, epcs...)
+	if err != nil {
+		return nil, err
+	}
+	refused := frame.RefusedEpcs()
+	switch frame.esv {
+	case 0x72: // Get_res
+	case 0x52: // Get_SNA
+		slog.Debug("GetProperties", "refused", formatEpcs(refused))
+	default:
+		return nil, fmt.Errorf("esv:0x%02x unexpected response", frame.esv)
+	}
+	props := make(map[byte][]byte, len(frame.edata))
+	for _, edata := range frame.edata {
+		if slices.Contains(refused, edata.epc) {
+			continue
+		}
+		props[edata.epc] = edata.edt
+	}
+	return props, nil
+}
+
+// PANAセッション確立後に通知されたインスタンスリスト
+func (m *Meter) Instances() [][3]byte {
+	return m.instances
+}
+
+// ノードプロファイルから自ノードインスタンスリストSを読み出す
+func (m *Meter) GetSelfNodeInstances(ctx context.Context) ([][3]byte, error) {
+	frame, err := m.GetFrom(ctx, EojNodeProfile, 0xd6)
+	if err != nil {
+		return nil, err
+	}
+	v, err := valueOf(frame, 0xd6)
+	if err != nil {
+		return nil, err
+	}
+	return v.([][3]byte), nil
+}
+
+// プロパティマップを読み出す
+// epcは0x9d(状変アナウンス), 0x9e(Set), 0x9f(Get)のいずれか
+func (m *Meter) GetPropertyMap(ctx context.Context, epc byte) (PropertyMap, error) {
+	switch epc {
+	case 0x9d, 0x9e, 0x9f:
+	default:
+		return nil, fmt.Errorf("epc:0x%02x is not a property map", epc)
+	}
+	v, err := m.getValue(ctx, epc)
+	if err != nil {
+		return nil, err
+	}
+	return v.(PropertyMap), nil
+}
+
+// 指定日の30分毎の積算電力量計測値履歴(正方向)を得る
+// 積算履歴収集日(0xe5)を書き込んで積算電力量計測値履歴1(0xe2)を読み出す
+// 値の無いコマはCumulativeNotAvailableになる
+func (m *Meter) GetHistory(ctx context.Context, daysAgo uint8) ([48]uint32, error) {
+	if daysAgo > MaxHistoryDaysAgo {
+		return [48]uint32{}, fmt.Errorf("daysAgo %d is out of range(0～%d)", daysAgo, MaxHistoryDaysAgo)
+	}
+	frame, err := m.setThenGet(ctx, 0xe5, []byte{daysAgo}, 0xe2)
+	if err != nil {
+		return [48]uint32{}, err
+	}
+	v, err := valueOf(frame, 0xe2)
+	if err != nil {
+		return [48]uint32{}, err
+	}
+	history := v.(CumulativeHistory)
+	if history.DaysAgo != uint16(daysAgo) {
+		return [48]uint32{}, fmt.Errorf("history of %d days ago was returned instead of %d", history.DaysAgo, daysAgo)
+	}
+	return history.Values, nil
+}
+
+// 指定日時から過去に遡ってslotsコマ分(30分毎)の積算電力量計測値履歴(正方向、逆方向)を得る
+// 積算履歴収集日2(0xed)を書き込んで積算電力量計測値履歴2(0xec)を読み出す
+// atの分は0か30で、slotsは1～12
+func (m *Meter) GetHistory2(ctx context.Context, at time.Time, slots uint8) (CumulativeHistory2, error) {
+	if slots < 1 || slots > MaxHistory2Slots {
+		return CumulativeHistory2{}, fmt.Errorf("slots %d is out of range(1～%d)", slots, MaxHistory2Slots)
+	}
+	at = at.In(MeterLocation)
+	if (at.Minute() != 0 && at.Minute() != 30) || at.Second() != 0 || at.Nanosecond() != 0 {
+		return CumulativeHistory2{}, fmt.Errorf("%s: minute must be 0 or 30", at.Format(time.RFC3339))
+	}
+	edt := HistoryCollectionTime2{Time: at, Slots: slots}.Encode()
+	frame, err := m.setThenGet(ctx, 0xed, edt, 0xec)
+	if err != nil {
+		return CumulativeHistory2{}, err
+	}
+	v, err := valueOf(frame, 0xec)
+	if err != nil {
+		return CumulativeHistory2{}, err
+	}
+	history := v.(CumulativeHistory2)
+	if !history.Time.Equal(at) {
+		return CumulativeHistory2{}, fmt.Errorf("history of %s was returned instead of %s", history.Time.Format(time.RFC3339), at.Format(time.RFC3339))
+	}
+	return history, nil
+}
+
+// setEpcにedtを書き込んでからgetEpcsの値を読み出した応答を返す
+// SetGetで1往復で済ませるが、SetGetに対応していないスマートメーターもあるので
+// 不可応答なら書き込みと読み出しを別々に行う
+// 読み出した値はvalueOfで取り出す
+func (m *Meter) setThenGet(ctx context.Context, setEpc byte, edt []byte, getEpcs ...byte) (*EchonetliteFrame, error) {
+	frame, err := m.SetGet(ctx, []EchonetliteEdata{{epc: setEpc, pdc: byte(len(edt)), edt: edt}}, getEpcs...)
+	if frame == nil || frame.esv != 0x5e {
+		return frame, err
+	}
+	slog.Debug("SetGet refused, fall back to SetC and Get", "refused", formatEpcs(frame.RefusedEpcs()))
+	if err := m.SetProperty(ctx, setEpc, edt); err != nil {
+		return nil, err
+	}
+	return m.Get(ctx, getEpcs...)
+}
+
+// スマートメーターの現在時刻を得る
+// 現在年月日設定(0x98)と現在時刻設定(0x97)を1つの要求で読み出して合わせる(秒は0)
+func (m *Meter) GetMeterTime(ctx context.Context) (time.Time, error) {
+	frame, err := m.Get(ctx, 0x98, 0x97)
+	if err != nil {
+		return time.Time{}, err
+	}
+	date, err := valueOf(frame, 0x98)
+	if err != nil {
+		return time.Time{}, err
+	}
+	clock, err := valueOf(frame, 0x97)
+	if err != nil {
+		return time.Time{}, err
+	}
+	d := date.(time.Time)
+	c := clock.(ClockTime)
+	return time.Date(d.Year(), d.Month(), d.Day(), int(c.Hour), int(c.Minute), 0, 0, MeterLocation), nil
+}
+
+// 瞬時電力計測値を得る
+func (m *Meter) GetInstantWatt(ctx context.Context) (int32, error) {
+	v, err := m.getValue(ctx, 0xe7)
+	if err != nil {
+		return 0, err
+	}
+	return v.(int32), nil
+}
+
+// 積算電力量計測値(正方向計測値)を得る
+func (m *Meter) GetCumulative(ctx context.Context) (uint64, error) {
+	v, err := m.getValue(ctx, 0xe0)
+	if err != nil {
+		return 0, err
+	}
+	return v.(uint64), nil
+}
+
+// プロパティ値を1つ読み出して解釈する
+func (m *Meter) getValue(ctx context.Context, epc byte) (any, error) {
+	frame, err := m.Get(ctx, epc)
+	if err != nil {
+		return nil, err
+	}
+	return valueOf(frame, epc)
+}
+
+// Get要求(またはSetGet要求)に対する応答から指定のEPCの値を取り出す
+// 不可応答(Get_SNA, SetGet_SNA)で拒否されていたらErrPropertyNotAvailableを返す
+func valueOf(frame *EchonetliteFrame, epc byte) (any, error) {
+	edata := frame.edata
+	switch frame.esv {
+	case 0x72: // Get_res
+	case 0x7e: // SetGet_res
+		edata = frame.getEdata
+	case 0x52, 0x5e: // Get_SNA, SetGet_SNA
+		if slices.Contains(frame.RefusedEpcs(), epc) {
+			return nil, &ErrPropertyNotAvailable{Epc: epc}
+		}
+		if frame.esv == 0x5e {
+			edata = frame.getEdata
+		}
+	default:
+		return nil, fmt.Errorf("epc:0x%02x esv:0x%02x unexpected response", epc, frame.esv)
+	}
+	for _, edata := range edata {
+		if edata.epc == epc {
+			return edata.Value()
+		}
+	}
+	return nil, fmt.Errorf("epc:0x%02x not found in response", epc)
+}
+
+// スマートメーターのプロパティ値を書き込む(SetC)
+// 書き込み応答(Set_res)を確認するまで待ち、不可応答(SetC_SNA)ならErrSetRefusedを返す
+func (m *Meter) SetProperty(ctx context.Context, epc byte, edt []byte) error {
+	frame, err := m.request(ctx, EchonetliteFrame{
+		ehd:   0x1081,
+		seoj:  EojHomeController,
+		deoj:  EojSmartmeter,
+		esv:   0x61, // プロパティ値書き込み要求(応答要)
+		opc:   1,
+		edata: []EchonetliteEdata{{epc: epc, pdc: byte(len(edt)), edt: edt}},
+	})
+	if err != nil {
+		return err
+	}
+	switch frame.esv {
+	case 0x71: // Set_res
+	case 0x51: // SetC_SNA
+		refused := frame.RefusedEpcs()
+		if len(refused) == 0 {
+			refused = []byte{epc}
+		}
+		return &ErrSetRefused{Epcs: refused}
+	default:
+		return fmt.Errorf("epc:0x%02x esv:0x%02x unexpected response", epc, frame.esv)
+	}
+	// 書き込み応答では受け付けたプロパティがPDC=0で返ってくる
+	for _, edata := range frame.edata {
+		if edata.epc == epc {
+			return nil
+		}
+	}
+	return fmt.Errorf("epc:0x%02x not found in response", epc)
+}
+
+// スマートメーターのプロパティ値の書き込みと読み出しを1つの要求(SetGet)で行う
+// 応答はSetGet_res(0x7e)かSetGet_SNA(0x5e)で、読み出した値はvalueOfで取り出す
+// 書き込みを拒否されたときは応答とともにエラーを返す
+func (m *Meter) SetGet(ctx context.Context, set []EchonetliteEdata, epcs ...byte) (*EchonetliteFrame, error) {
+	frame, err := m.request(ctx, NewSetGetFrame(EojSmartmeter, set, epcs))
+	if err != nil {
+		return nil, err
+	}
+	switch frame.esv {
+	case 0x7e: // SetGet_res
+	case 0x5e: // SetGet_SNA
+		if refused := refusedSetEpcs(frame.edata); len(refused) > 0 {
+			return frame, &ErrSetRefused{Epcs: refused}
+		}
+	default:
+		return nil, fmt.Errorf("esv:0x%02x unexpected response", frame.esv)
+	}
+	return frame, nil
+}
+
+// 次のトランザクションIDを得る(0xffffの次は0に戻る)
+func (m *Meter) nextTid() uint16 {
+	m.tid++
+	return m.tid
+}
+
+// echonet lite電文を送信して応答を待つ
+// トランザクションIDはここで割り当てる
+func (m *Meter) request(ctx context.Context, frame EchonetliteFrame) (*EchonetliteFrame, error) {
+	frame.tid = m.nextTid()
+	err := m.transmit(ctx, frame.Encode())
+	if err != nil {
+		return nil, err
+	}
+	// 関係の無い電文を受け取っても待ち時間は延ばさない
+	timeout := m.after(m.timeout)
+	for {
+		select {
+		case r := <-m.rxFrameChan:
+			switch r.esv {
+			case 0x50, 0x51, 0x52, 0x5e, 0x71, 0x72, 0x7e: // 要求に対する応答
+				if r.tid != frame.tid {
+					// 他の要求に対する応答は待っているものではない
+					slog.Warn("unmatched response", "tid", r.tid, "want", frame.tid, "esv", r.esv)
+					continue
+				}
+				m.remember(r)
+				return r, nil
+			default: // 要求に対する応答以外
+				r.Show()
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-m.receiverDone:
+			return nil, m.receiverErr
+		case <-timeout:
+			return nil, ErrUartReadTimeoutExceeded
+		}
+	}
+}
+
+// 積算電力量計測値の換算に必要な係数(0xd3)と単位(0xe1)を覚えておく
+// 不可応答(Get_SNA)でも受け付けられたプロパティは覚える
+func (m *Meter) remember(frame *EchonetliteFrame) {
+	var refused []byte
+	switch frame.esv {
+	case 0x72: // Get_res
+	case 0x52: // Get_SNA
+		refused = frame.RefusedEpcs()
+	default:
+		return
+	}
+	m.cumulativeMu.Lock()
+	defer m.cumulativeMu.Unlock()
+	for _, edata := range frame.edata {
+		if slices.Contains(refused, edata.epc) {
+			continue
+		}
+		switch edata.epc {
+		case 0xd3: // 係数
+			if v, err := edata.Value(); err == nil {
+				m.scale.Coefficient = v.(uint32)
+			}
+		case 0xd7: // 積算電力量有効桁数
+			if v, err := edata.Value(); err == nil {
+				m.scale.Digits = v.(uint8)
+			}
+		case 0xe1: // 積算電力量単位
+			if v, err := edata.Value(); err == nil {
+				m.scale.PowersOfTen = v.(int)
+				m.scaleErr = nil
+			} else {
+				m.scaleErr = fmt.Errorf("積算電力量単位(0xe1)が規定外 edt:%x %w", edata.edt, err)
+			}
+		}
+	}
+}
+
+// 積算電力量計測値の換算を得る
+// 積算電力量単位(0xe1)が未取得または規定外ならエラー
+func (m *Meter) CumulativeScale() (CumulativeScale, error) {
+	m.cumulativeMu.Lock()
+	defer m.cumulativeMu.Unlock()
+	return m.scale, m.scaleErr
+}
+
+// 積算電力量計測値の換算に必要な係数(0xd3)と単位(0xe1)、増分の計算に使う有効桁数(0xd7)を読み出す
+// 係数が存在しないスマートメーターもあるので係数と有効桁数の読み出し失敗は無視する
+func (m *Meter) LoadCumulativeScale(ctx context.Context) error {
+	if _, err := m.Get(ctx, 0xd3); err != nil {
+		slog.Debug("LoadCumulativeScale", "err", err)
+	}
+	if _, err := m.Get(ctx, 0xd7); err != nil {
+		slog.Debug("LoadCumulativeScale", "err", err)
+	}
+	if _, err := m.Get(ctx, 0xe1); err != nil {
+		return err
+	}
+	_, err := m.CumulativeScale()
+	return err
+}
+
+// 積算電力量計測値(正方向計測値)をkWhで得る
+func (m *Meter) GetCumulativeKWh(ctx context.Context) (float64, error) {
+	if _, err := m.CumulativeScale(); err != nil {
+		if err := m.LoadCumulativeScale(ctx); err != nil {
+			return 0, err
+		}
+	}
+	raw, err := m.GetCumulative(ctx)
+	if err != nil {
+		return 0, err
+	}
+	scale, err := m.CumulativeScale()
+	if err != nil {
+		return 0, err
+	}
+	return scale.KWh(raw), nil
+}
+
+// 積算電力量計測値の正方向(0xe0)と逆方向(0xe3)をkWhで得る
+// 換算に必要な係数(0xd3)と単位(0xe1)も1つのGet要求でまとめて読み出す
+// 係数が存在しないスマートメーターでは不可応答(Get_SNA)になるが、係数は1のままで換算する
+func (m *Meter) GetCumulativeBoth(ctx context.Context) (forward float64, reverse float64, err error) {
+	frame, err := m.Get(ctx, 0xd3, 0xe1, 0xe0, 0xe3)
+	if err != nil {
+		return 0, 0, err
+	}
+	scale, err := m.CumulativeScale()
+	if err != nil {
+		return 0, 0, err
+	}
+	f, err := valueOf(frame, 0xe0)
+	if err != nil {
+		return 0, 0, err
+	}
+	r, err := valueOf(frame, 0xe3)
+	if err != nil {
+		return 0, 0, err
+	}
+	return scale.KWh(f.(uint64)), scale.KWh(r.(uint64)), nil
+}
+
+// interval毎に瞬時電力、瞬時電流、積算電力量を読み取ってReadingを送り続ける
+// 接続済みのMeterで呼ぶこと
+// 読み取りの失敗はエラーのチャンネルに送って読み取りを続ける(受け取られなければログに出す)
+// シリアルポートが読めなくなったときはエラーを送って終了する
+// ctxを中断すると両方のチャンネルを閉じる
+func (m *Meter) Stream(ctx context.Context, interval time.Duration) (<-chan Reading, <-chan error) {
+	readings := make(chan Reading, 1)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		defer close(readings)
+		// 積算電力量計測値の換算に必要な係数と単位が無ければ積算電力量は読まない
+		epcs := []byte{0xe7, 0xe8}
+		if err := m.LoadCumulativeScale(ctx); err != nil {
+			slog.Warn("Stream", "err", err)
+		} else {
+			epcs = append(epcs, 0xe0)
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			frame, err := m.Get(ctx, epcs...)
+			switch {
+			case ctx.Err() != nil:
+				return
+			case errors.Is(err, ErrSerialReadFailed):
+				select {
+				case errs <- err:
+				case <-ctx.Done():
+				}
+				return
+			case err != nil:
+				select {
+				case errs <- err:
+				default:
+					slog.Warn("Stream", "err", err)
+				}
+			default:
+				if r, ok := m.reading(frame, time.Now()); ok {
+					select {
+					case readings <- r:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return readings, errs
+}
+
+// 積算電力量計測値(正方向)を覚えて、前回からの増分をWhで返す
+// 初回、前回より古い計測値、換算や一周の判断ができないときはfalseを返す
+func (m *Meter) CumulativeDeltaWh(raw uint64, at time.Time) (float64, bool) {
+	m.cumulativeMu.Lock()
+	defer m.cumulativeMu.Unlock()
+	prev, prevAt := m.prevCumulative, m.prevCumulativeAt
+	if !prevAt.IsZero() && at.Before(prevAt) {
+		return 0, false
+	}
+	m.prevCumulative, m.prevCumulativeAt = raw, at
+	if prevAt.IsZero() || m.scaleErr != nil {
+		return 0, false
+	}
+	delta, ok := m.scale.Delta(prev, raw)
+	if !ok {
+		return 0, false
+	}
+	return m.scale.KWh(delta) * 1000, true
+}
+
+// データを送信する
+// 再送で回復する見込みのある失敗なら再送方針に従って再送する
+func (m *Meter) transmit(ctx context.Context, b []byte) error {
+	backoff := m.retryPolicy.Backoff
+	for retry := 0; ; retry++ {
+		err := m.transmitOnce(ctx, b)
+		var transmitErr *TransmitError
+		if !errors.As(err, &transmitErr) || !transmitErr.Temporary() || retry >= m.retryPolicy.Count {
+			return err
+		}
+		slog.Warn("retransmit", slog.Int("retry", retry+1), slog.Duration("backoff", backoff), "err", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-m.after(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// 最後に成功したデータ送信要求応答(0x2008)
+func (m *Meter) LastTransmitResult() TransmitResult {
+	return m.lastTransmit
+}
+
+// データを1回送信する
+func (m *Meter) transmitOnce(ctx context.Context, b []byte) error {
+	if m.conn == nil {
+		return ErrNotConnected
+	}
+	// 応答コマンドコード:0x2008, 結果コード:0x01を確認する
+	r, err := m.exchange(ctx, "Write", 0x2008, func() error {
+		_, err := m.conn.Write(b)
+		return err
+	})
+	if err != nil {
+		if r.Header.CommandCode == 0x2008 {
+			return NewTransmitError(r)
+		}
+		return err
+	}
+	m.lastTransmit = ParseTransmitResult(r)
+	slog.Debug("Write",
+		slog.String("transmit result", fmt.Sprintf("0x%02x", m.lastTransmit.TransmitResult)),
+		slog.String("trailer", hex.EncodeToString(m.lastTransmit.Trailer)))
+	return nil
+}
+
+// データを受信し続ける
+// ctxが取り消されるか接続が閉じられたら止める
+// 壊れたデータはそのデータだけ捨てて続け、シリアルポートが読めなくなったなど続けられないエラーなら止める
+func (m *Meter) receiver(ctx context.Context, conn *ConnEchonetlite) {
+	for {
+		buffer := make([]byte, 1500) // 最大受信サイズはヘッダ部を含めて1361バイト
+		n, err := conn.ReadContext(ctx, buffer)
+		if errors.Is(err, net.ErrClosed) || ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, ErrMalformedData) {
+			slog.Warn("read", "err", err)
+			continue
+		}
+		if err != nil {
+			slog.Error("receiver stopped", "err", err)
+			return
+		}
+		m.rssi.Store(int32(conn.rssi))
+		frame, err := ParseEchonetliteFrame(buffer[:n])
+		if err != nil {
+			slog.Warn("read", "err", err, "data", hex.EncodeToString(buffer[:n]))
+			continue
+		}
+		if frame.esv == 0x73 || frame.esv == 0x74 { // INF, INFC
+			// 自発的な通知は要求に対する応答と取り違えないように別に扱う
+			m.notify(frame)
+			continue
+		}
+		select {
+		case m.rxFrameChan <- frame:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// 通知(INF, INFC)を受け取る関数を登録する
+// 関数は受信ゴルーチンから呼ばれるので、Connectより前に登録して処理はすぐに戻すこと
+func (m *Meter) OnNotify(handler func(*EchonetliteFrame)) {
+	m.notifyHandler = handler
+}
+
+// 通知(INF, INFC)を登録された関数に渡す
+// インスタンスリスト通知はPANAセッション確立を待っているところにも渡す
+func (m *Meter) notify(frame *EchonetliteFrame) {
+	if slices.ContainsFunc(frame.edata, func(e EchonetliteEdata) bool { return e.epc == 0xd5 }) {
+		select {
+		case m.rxInstanceListChan <- frame:
+		default:
+		}
+	}
+	if m.notifyHandler != nil {
+		m.notifyHandler(frame)
+	} else {
+		frame.Show()
+	}
+}
+
+// ハードウェアリセットする
+func (m *Meter) reset(ctx context.Context) error {
+	//
+	// ハードウェアリセット要求コマンドを発行する
+	//
+	// USBを挿した直後などは最初のリセット要求を取りこぼすことがあるので、
+	// 短く待って起動完了通知が無ければもう一度だけリセット要求を出す
+	first := min(ResetRetryTimeout, m.timeout)
+	for i, wait := range []time.Duration{first, m.timeout} {
+		if i > 0 {
+			// 最初のリセット要求に対する遅れた起動完了通知を、
+			// もう一度出したリセット要求に対するものと取り違えないように捨てておく
+			m.discardNotifications()
+		}
+		_, err := CommandHardwareReset().Write(m.stream)
+		if err != nil {
+			return err
+		}
+		err = m.waitBootCompleted(ctx, wait)
+		if !errors.Is(err, ErrHardwareResetNoResponse) || i > 0 {
+			return err
+		}
+		slog.Warn("no boot notification, resetting again", "err", err)
+	}
+	return nil
+}
+
+// 届いている通知を読み捨てる
+func (m *Meter) discardNotifications() {
+	for {
+		select {
+		case r := <-m.rxNotifyChan:
+			slog.Debug("discarded notification", "code", fmt.Sprintf("0x%04x", r.Header.CommandCode), "data", hex.EncodeToString(r.Data))
+		default:
+			return
+		}
+	}
+}
+
+// ハードウェアリセット後の起動完了通知(0x6019)を待つ
+// ファームウェアによっては0x6019の前後に別の通知(0x601x等)を出すことがある
+// それらはログに出して読み捨て、順序に関わらずtimeout以内に0x6019が来れば成功とする
+func (m *Meter) waitBootCompleted(ctx context.Context, timeout time.Duration) error {
+	deadline := m.after(timeout)
+	var others []string
+	for {
+		select {
+		case r := <-m.rxNotifyChan:
+			if r.Header.CommandCode == 0x6019 {
+				return nil
+			}
+			others = append(others, fmt.Sprintf("0x%04x", r.Header.CommandCode))
+			slog.Info("boot notification", "code", fmt.Sprintf("0x%04x", r.Header.CommandCode), "data", hex.EncodeToString(r.Data))
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-m.receiverDone:
+			return m.receiverErr
+		case <-deadline:
+			if len(others) > 0 {
+				return fmt.Errorf("%w (received %s but not 0x6019)", ErrHardwareResetNoResponse, strings.Join(others, ","))
+			}
+			return ErrHardwareResetNoResponse
+		}
+	}
+}
+
+// アダプタのファームウェアバージョンを得る
+func (m *Meter) GetFirmwareVersion(ctx context.Context) (string, error) {
+	//
+	// ファームウェアバージョン取得コマンドを発行する
+	//
+	// 応答コマンドコード:0x206b, 結果コード:0x01を確認する
+	r, err := m.command(ctx, "CommandGetFirmwareVersion", CommandGetFirmwareVersion())
+	if err != nil {
+		return "", err
+	}
+	return ParseResponseFirmwareVersion(r)
+}
+
+// 初期設定とPANA認証情報設定をする
+func (m *Meter) setup(ctx context.Context) error {
+	if m.routeBId == (RouteBId{}) || m.routeBPassword == (RouteBPassword{}) {
+		return ErrCredentialsRequired
+	}
+	//
+	// 初期設定要求コマンドを発行する
+	//
+	// 応答コマンドコード:0x205f, 結果コード:0x01を確認する
+	if _, err := m.command(ctx, "CommandInitialSetup", CommandInitialSetup(m.channel, m.setupOptions)); err != nil {
+		return err
+	}
+
+	//
+	// BルートPANA認証情報設定要求コマンドを発行する
+	//
+	// 応答コマンドコード:0x2054, 結果コード:0x01を確認する
+	if _, err := m.command(ctx, "CommandSetPanaAuthInfo", CommandSetPanaAuthInfo(m.routeBId, m.routeBPassword)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// アクティブスキャンでBeacon応答が無かった
+var ErrScanNoBeacon = errors.New("active scan found no beacon")
+
+// スキャン時間の最大値
+const MaxScanDuration uint8 = 14
+
+// スキャン時間の既定値
+const DefaultScanDuration uint8 = 7
+
+// Beacon応答が無かったときにやり直す回数の既定値
+const DefaultScanRetries int = 3
+
+// アクティブスキャンでスマートメーターを探す
+// channelMaskはスキャンするチャネルのビットマスク(ScanChannelMask参照)
+// Beacon応答が無ければスキャン時間を1ずつ(最大14まで)長くして最大retries回やり直す
+// 応答のあったスマートメーターを全て返す(SelectBeacon参照)
+func (m *Meter) ActiveScan(ctx context.Context, scanDuration uint8, channelMask uint32, retries int) ([]BeaconResponse, error) {
+	err := m.reset(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = m.setup(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; ; attempt++ {
+		slog.Info("ActiveScan", slog.Int("attempt", attempt+1), slog.Int("scanDuration", int(scanDuration)))
+		found, err := m.activeScanOnce(ctx, scanDuration, channelMask)
+		if !errors.Is(err, ErrScanNoBeacon) || attempt >= retries {
+			return found, err
+		}
+		if scanDuration < MaxScanDuration {
+			scanDuration++
+		}
+	}
+}
+
+// スキャンに掛かる時間に加えてBeacon応答を待つ時間
+// 最後のチャネルの応答が届くまでの余裕
+const ScanWaitMargin = 2 * time.Second
+
+// アクティブスキャンに掛かる時間
+// 1チャネルあたり 9.6ms×(2^スキャン時間+1)
+func scanWindow(scanDuration uint8, channelMask uint32) time.Duration {
+	perChannel := 9600 * time.Microsecond * time.Duration(1<<scanDuration+1)
+	return perChannel * time.Duration(bits.OnesCount32(channelMask))
+}
+
+// アクティブスキャンを1回行う
+func (m *Meter) activeScanOnce(ctx context.Context, scanDuration uint8, channelMask uint32) ([]BeaconResponse, error) {
+	// アクティブスキャン結果を受け取るチャネル
+	foundBeaconChan := make(chan BeaconResponse, 16)
+	// アクティブスキャン通知を処理するゴルーチンを起動する
+	// スキャン毎に起動して、このスキャンが終わったら止める
+	scanCtx, cancelScan := context.WithCancel(ctx)
+	scanComplete := make(chan struct{})
+	handlerDone := make(chan struct{})
+	go func() {
+		defer close(handlerDone)
+		handleNotifyActivescan(scanCtx, m.rxNotifyChan, foundBeaconChan, bits.OnesCount32(channelMask), scanComplete)
+	}()
+	// 止めたゴルーチンが次のリセットの起動完了通知を横取りしないように、終わるまで待ってから戻る
+	defer func() {
+		cancelScan()
+		<-handlerDone
+	}()
+	//
+	// アクティブスキャン要求コマンドを発行する
+	//
+	// 応答コマンドコード:0x2051, 結果コード:0x01を確認する
+	if _, err := m.command(ctx, "CommandActivescan", CommandActivescan(scanDuration, channelMask, m.routeBId)); err != nil {
+		return nil, err
+	}
+	// UART読み取りタイムアウト値ではなくスキャンに掛かる時間だけ待つ
+	scanEnd := m.after(scanWindow(scanDuration, channelMask) + ScanWaitMargin)
+
+	// 近所のスマートメーターも応答するかもしれないので、
+	// 全てのチャネルのスキャン数の分のBeacon応答を受け取るかスキャンが終わるまで集めてから選ぶ
+	var found []BeaconResponse
+	for collecting := true; collecting; {
+		select {
+		case beacon := <-foundBeaconChan:
+			found = addBeacon(found, beacon)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-scanComplete:
+			// completeを閉じる前に送られたBeacon応答を取りこぼさないように受け取っておく
+			for len(foundBeaconChan) > 0 {
+				found = addBeacon(found, <-foundBeaconChan)
+			}
+			collecting = false
+		case <-scanEnd:
+			collecting = false
+		}
+	}
+	if len(found) == 0 {
+		return nil, ErrScanNoBeacon
+	}
+	for _, beacon := range found {
+		slog.Info("Found smartmeter", "beacon", beacon)
+	}
+	return found, nil
+}
+
+// 同じスマートメーターからの応答はRSSIの強い方を残す
+func addBeacon(found []BeaconResponse, beacon BeaconResponse) []BeaconResponse {
+	for i := range found {
+		if found[i].macAddress == beacon.macAddress {
+			if beacon.rssi > found[i].rssi {
+				found[i] = beacon
+			}
+			return found
+		}
+	}
+	return append(found, beacon)
+}
+
+// 応答のあったスマートメーターから1つ選ぶ
+// macAddressが0ならRSSIの一番強いもの、そうでなければMACアドレスが一致するもの
+func SelectBeacon(found []BeaconResponse, macAddress uint64) (BeaconResponse, error) {
+	if len(found) == 0 {
+		return BeaconResponse{}, ErrScanNoBeacon
+	}
+	if macAddress != 0 {
+		for _, beacon := range found {
+			if beacon.macAddress == macAddress {
+				return beacon, nil
+			}
+		}
+		return BeaconResponse{}, fmt.Errorf("no beacon from mac address %016x", macAddress)
+	}
+	strongest := found[0]
+	for _, beacon := range found[1:] {
+		if beacon.rssi > strongest.rssi {
+			strongest = beacon
+		}
+	}
+	return strongest, nil
+}
+
+// 要求コマンドを発行して応答を待つ
+// 応答コマンドコードは要求コマンドコードに0x2000を加えたもの
+// 結果コードが0x01(成功)でなければエラーを返す
+func (m *Meter) command(ctx context.Context, name string, c J11Datagram) (J11Datagram, error) {
+	return m.exchange(ctx, name, c.Header.CommandCode|0x2000, func() error {
+		_, err := c.Write(m.stream)
+		return err
+	})
+}
+
+// 応答を待ち受けてからsendで送信して指定のコマンド応答を待つ
+// 結果コードが0x01(成功)でなければエラーを返す
+func (m *Meter) exchange(ctx context.Context, name string, commandCode uint16, send func() error) (J11Datagram, error) {
+	// 取り消されていたら送信しない
+	if err := ctx.Err(); err != nil {
+		return J11Datagram{}, err
+	}
+	rx, cancel := m.router.Expect(commandCode)
+	defer cancel()
+	if err := send(); err != nil {
+		return J11Datagram{}, err
+	}
+	select {
+	case r := <-rx:
+		if len(r.Data) >= 1 && r.Data[0] == 1 {
+			slog.Debug(name, slog.String("result", "ok"))
+			return r, nil
+		}
+		return r, NewCommandError(name, r)
+	case <-ctx.Done():
+		return J11Datagram{}, ctx.Err()
+	case <-m.receiverDone:
+		return J11Datagram{}, m.receiverErr
+	case <-m.after(m.timeout):
+		return J11Datagram{}, ErrUartReadTimeoutExceeded
+	}
+}
+
+// 指定の通知を待つ
+// 他の通知を受け取っても待ち時間は延ばさない
+func (m *Meter) waitNotify(ctx context.Context, commandCode uint16) (J11Datagram, error) {
+	timeout := m.after(m.timeout)
+	for {
+		select {
+		case r := <-m.rxNotifyChan:
+			if r.Header.CommandCode == commandCode {
+				return r, nil
+			}
+		case <-ctx.Done():
+			return J11Datagram{}, ctx.Err()
+		case <-m.receiverDone:
+			return J11Datagram{}, m.receiverErr
+		case <-timeout:
+			return J11Datagram{}, ErrUartReadTimeoutExceeded
+		}
+	}
+}
+
+// 0x4051: アクティブスキャン通知を処理する
+// スキャンの進み具合(スキャンしたチャネル数/channels)をチャネル毎に表示する
+// スキャン数(Data[2])はそのチャネルで応答したスマートメーターの数で、
+// 1つの通知に続けて並んでいることも、複数の通知に分かれて届くこともある
+// 全てのチャネルをスキャンして、スキャン数の分のBeacon応答を受け取ったらcompleteを閉じる
+func handleNotifyActivescan(ctx context.Context, rxNotify chan J11Datagram, found chan BeaconResponse, channels int, complete chan struct{}) {
+	scanned := map[uint8]bool{} // スキャンしたチャネルとBeacon応答の有無
+	expected := map[uint8]int{} // チャネル毎のスキャン数
+	received := map[uint8]int{} // チャネル毎に受け取ったBeacon応答の数
+	closed := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case r := <-rxNotify:
+			if r.Header.CommandCode == 0x4051 {
+				notify, ok := parseNotifyActivescan(r)
+				if !ok {
+					slog.Debug("NotifyActivescan too short", "data", hex.EncodeToString(r.Data))
+					continue
+				}
+				resultCode, channel := notify.result, notify.channel
+				beacon, seen := scanned[channel]
+				scanned[channel] = beacon || resultCode == 0
+				if !seen || (!beacon && resultCode == 0) {
+					slog.Info("scan progress",
+						slog.Int("channel", int(channel)),
+						slog.Bool("beacon", resultCode == 0),
+						slog.String("scanned", fmt.Sprintf("%d/%d", len(scanned), channels)))
+				}
+				if len(notify.beacons) > 0 {
+					// Beacon応答あり
+					expected[channel] = max(expected[channel], notify.count)
+					for _, b := range notify.beacons {
+						// スマートメーターを検出した
+						select {
+						case found <- b:
+						case <-ctx.Done():
+							return
+						}
+						received[channel]++
+					}
+				} else {
+					// Beacon応答無し
+					slog.Debug("NotifyActivescan", "resultCode", resultCode, "channel", channel)
+				}
+				if !closed && len(scanned) >= channels && allReceived(expected, received) {
+					closed = true
+					close(complete)
+				}
+			}
+		}
+	}
+}
+
+// 全てのチャネルでスキャン数の分のBeacon応答を受け取っていればtrue
+func allReceived(expected map[uint8]int, received map[uint8]int) bool {
+	for channel, count := range expected {
+		if received[channel] < count {
+			return false
+		}
+	}
+	return true
+}
+
+// アクティブスキャン通知(0x4051)の内容
+type notifyActivescan struct {
+	result  uint8            // スキャン結果(0ならBeacon応答あり)
+	channel uint8            // スキャンチャネル
+	count   int              // スキャン数(このチャネルで応答したスマートメーターの数)
+	beacons []BeaconResponse // この通知に並んでいるBeacon応答
+}
+
+// 0x4051: アクティブスキャン通知を解釈する
+// スキャン結果とスキャンチャネルも無い短すぎる通知ならfalseを返す
+func parseNotifyActivescan(r J11Datagram) (notifyActivescan, bool) {
+	// Data[0] = スキャン結果
+	// Data[1] = スキャンチャネル
+	// スキャン結果 = 0なら以下の情報が付加される
+	// Data[2] = スキャン数
+	// Data[3,4,5,6,7,8,9,10] = MACアドレス
+	// Data[11,12] = PANID
+	// Data[13] = rssi
+	// スキャン数が2以上ならMACアドレス、PANID、rssiの11バイトがスキャン数の分だけ並ぶことがある
+	if len(r.Data) < 2 {
+		return notifyActivescan{}, false
+	}
+	notify := notifyActivescan{result: r.Data[0], channel: r.Data[1]}
+	if notify.result != 0 || len(r.Data) < 14 {
+		return notify, true
+	}
+	notify.count = max(int(r.Data[2]), 1)
+	for i := 0; i < notify.count && 3+11*(i+1) <= len(r.Data); i++ {
+		entry := r.Data[3+11*i:]
+		notify.beacons = append(notify.beacons, BeaconResponse{
+			channel:    notify.channel,
+			macAddress: binary.BigEndian.Uint64(entry[0:8]),
+			panId:      binary.BigEndian.Uint16(entry[8:10]),
+			rssi:       int8(entry[10]),
+		})
+	}
+	return notify, true
+}
+
+// 0x6028: PANA認証結果通知を処理する
+// 短すぎる通知は規定の無いコード(0)として扱う
+func parseNotifyPanaResult(r J11Datagram) (uint8, [8]byte) {
+	if len(r.Data) < 9 {
+		return 0, [8]byte{}
+	}
+	result := r.Data[0]
+	macAddress := [8]byte(r.Data[1:9])
+	return result, macAddress
+}
+
+// UDPポート(既定は0e1a)でEchonet liteを入出力する仕掛け
+type ConnEchonetlite struct {
+	stream            io.Writer
+	ipv6              netip.Addr
+	port              uint16 // オープンしたUDPポート(送信元ポート)
+	remotePort        uint16 // 送信先ポート
+	rxNotifyChan      chan J11Datagram
+	closed            chan struct{}
+	senderAddress     netip.Addr
+	senderPort        uint16
+	dstPort           uint16
+	panId             uint16
+	senderAddressType uint8
+	secure            uint8
+	rssi              int8
+	dataBytes         uint16
+	data              []byte
+	capture           *FrameCapture   // 送受信した電文の記録先(nilなら記録しない)
+	receiverDone      <-chan struct{} // uartReceiverが終了したら閉じる(nilなら待たない)
+}
+
+func NewConnEchonetlite(w io.Writer, address netip.Addr, port uint16, remotePort uint16, rxNotify chan J11Datagram) *ConnEchonetlite {
+	return &ConnEchonetlite{stream: w, ipv6: address, port: port, remotePort: remotePort, rxNotifyChan: rxNotify, closed: make(chan struct{})}
+}
+
+// 読み取りを止める
+// ブロックしているReadはnet.ErrClosedを返す
+func (c *ConnEchonetlite) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func (c *ConnEchonetlite) Read(b []byte) (int, error) {
+	return c.ReadContext(context.Background(), b)
+}
+
+// ctxが取り消されたら受信を待つのをやめる
+func (c *ConnEchonetlite) ReadContext(ctx context.Context, b []byte) (int, error) {
+	r := J11Datagram{}
+	// データ受信通知: 0x6018を確認するまでブロック
+	for {
+		select {
+		case r = <-c.rxNotifyChan:
+		case <-c.closed:
+			return 0, net.ErrClosed
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-c.receiverDone:
+			// シリアルポートが読めなくなったのでもう通知は来ない
+			return 0, fmt.Errorf("%w: uart receiver stopped", ErrSerialReadFailed)
+		}
+		if r.Header.CommandCode != 0x6018 {
+			slog.Debug("ignored", "rxNotify", r)
+			continue
+		}
+		// Echonet lite以外のUDPポート宛のデータは読まない
+		if len(r.Data) >= 20 {
+			if dstPort := binary.BigEndian.Uint16(r.Data[18:20]); dstPort != c.port {
+				slog.Debug("ignored", "dstPort", dstPort, "data", hex.EncodeToString(r.Data))
+				continue
+			}
+		}
+		break
+	}
+	// Data[0,1,2,3,4,5,6,7,8,9,10,11,12,13,14,15] = 送信元IPv6 アドレス
+	// Data[16,17] = 送信元ポート番号
+	// Data[18,19] = 送信先ポート番号
+	// Data[20,21] = 送信元PAN ID
+	// Data[22] = 送信先アドレス種別
+	// Data[23] = 暗号化
+	// Data[24] = RSSI
+	// Data[25,26] = 受信データサイズ
+	// Data[27:] = 受信データ
+	if len(r.Data) < 27 {
+		return 0, fmt.Errorf("%w: data receive notification too short(%d)", ErrMalformedData, len(r.Data))
+	}
+	c.senderAddress = netip.AddrFrom16([16]byte(r.Data[0:16]))
+	c.senderPort = binary.BigEndian.Uint16(r.Data[16:18])
+	c.dstPort = binary.BigEndian.Uint16(r.Data[18:20])
+	c.panId = binary.BigEndian.Uint16(r.Data[20:22])
+	c.senderAddressType = r.Data[22]
+	c.secure = r.Data[23]
+	c.rssi = int8(r.Data[24])
+	c.dataBytes = binary.BigEndian.Uint16(r.Data[25:27])
+	c.data = r.Data[27:]
+	senderAddressType := "N/A"
+	switch c.senderAddressType {
+	case 0x00:
+		senderAddressType = "ユニキャスト"
+	case 0x01:
+		senderAddressType = "マルチキャスト"
+	}
+	secure := "N/A"
+	switch c.secure {
+	case 0x01:
+		secure = "暗号化なし"
+	case 0x02:
+		secure = "暗号化あり"
+	}
+	slog.Debug("Received",
+		//		slog.Int("senderPort", int(c.senderPort)),
+		//		slog.Int("dstPort", int(c.dstPort)),
+		//		slog.Int("panId", int(c.panId)),
+		slog.String("senderAddressType", senderAddressType),
+		slog.String("secure", secure),
+		slog.Int("rssi", int(c.rssi)),
+		slog.Int("dataBytes", int(c.dataBytes)),
+		slog.String("data(hex)", hex.EncodeToString(c.data)),
+	)
+	c.capture.Record(CaptureRx, c.data)
+	return copy(b, c.data), nil
+}
+
+func (c *ConnEchonetlite) Write(b []byte) (int, error) {
+	// データ送信要求コマンドを発行する
+	j11command, err := CommandTransmitData(c.ipv6, c.port, c.remotePort, b)
+	if err != nil {
+		return 0, err
+	}
+	c.capture.Record(CaptureTx, b)
+	return j11command.Write(c.stream)
+}
@@ -0,0 +1,838 @@
+// BP35Cx-J11を使ってスマートメータから電力消費量などを得る
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 Akihiro Yamamoto <github.com/ak1211>
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"io"
+	"maps"
+	"math"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 記録したセッションの1つの要求コマンドとそれに対するアダプタからの受信データ
+type sessionStep struct {
+	tx uint16 // 要求コマンドのコマンドコード
+	rx []byte // 応答と通知
+}
+
+// testdataにある記録したセッションを読む
+//
+//	tx <コマンドコード>: アダプタに書き込まれる要求コマンド
+//	rx <16進数>: 直前のtxの要求コマンドを書き込まれたアダプタが返すデータグラム
+//
+// #で始まる行と空行は読み飛ばす
+func loadSession(t *testing.T, name string) []sessionStep {
+	t.Helper()
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var steps []sessionStep
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		kind, value, _ := strings.Cut(text, " ")
+		switch kind {
+		case "tx":
+			code, err := strconv.ParseUint(value, 16, 16)
+			if err != nil {
+				t.Fatalf("%s:%d: %v", name, line, err)
+			}
+			steps = append(steps, sessionStep{tx: uint16(code)})
+		case "rx":
+			b, err := hex.DecodeString(value)
+			if err != nil || len(steps) == 0 {
+				t.Fatalf("%s:%d: bad rx line", name, line)
+			}
+			steps[len(steps)-1].rx = append(steps[len(steps)-1].rx, b...)
+		default:
+			t.Fatalf("%s:%d: unknown line %q", name, line, text)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return steps
+}
+
+// 記録したセッションを再生するシリアルポートを作る
+// 書き込まれた要求コマンドが記録の次のtxと同じコマンドコードなら、それに続くrxを受信データにする
+// 違っていたらテストを失敗させて何も返さない
+func replaySession(t *testing.T, steps []sessionStep) *fakeSerialPort {
+	port := newFakeSerialPort()
+	next := 0
+	port.respond = func(b []byte) []byte {
+		if len(b) < J11DatagramHeaderBytes {
+			t.Errorf("short command %x", b)
+			return nil
+		}
+		code := binary.BigEndian.Uint16(b[4:6])
+		if next >= len(steps) {
+			t.Errorf("command 0x%04x was written after the end of the session", code)
+			return nil
+		}
+		if want := steps[next].tx; code != want {
+			t.Errorf("command #%d = 0x%04x, want 0x%04x", next, code, want)
+			return nil
+		}
+		next++
+		return steps[next-1].rx
+	}
+	return port
+}
+
+// 書き込まれた要求コマンドのコマンドコード
+func writtenCommandCodes(port *fakeSerialPort) []uint16 {
+	port.mu.Lock()
+	defer port.mu.Unlock()
+	var codes []uint16
+	for _, b := range port.written {
+		codes = append(codes, binary.BigEndian.Uint16(b[4:6]))
+	}
+	return codes
+}
+
+// 待ち時間が過ぎることの無い時計
+// 記録したセッションの再生が壁時計の速さに左右されないようにする
+func neverAfter(time.Duration) <-chan time.Time {
+	return nil
+}
+
+func TestReplaySession(t *testing.T) {
+	steps := loadSession(t, "testdata/session.txt")
+	port := replaySession(t, steps)
+	meter, err := NewMeter(port, Settings{
+		RouteBId:       "0123456789ABCDEF0123456789ABCDEF",
+		RouteBPassword: "abcdefghijkl",
+		Channel:        4,
+		MacAddress:     "001d129012340000",
+		PanId:          0x1234,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	meter.after = neverAfter
+	var (
+		mu       sync.Mutex
+		notified []*EchonetliteFrame
+	)
+	meter.OnNotify(func(frame *EchonetliteFrame) {
+		mu.Lock()
+		defer mu.Unlock()
+		notified = append(notified, frame)
+	})
+	// 記録と食い違って応答が来ないときに待ち続けないようにする
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// 認証に失敗してアクティブスキャンで探し直したスマートメーターに接続する
+	if err := meter.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	found, ok := meter.Rescanned()
+	if !ok || found.channel != 9 || found.macAddress != 0x001d129012345678 || found.panId != 0x1234 || found.rssi != -60 {
+		t.Errorf("Rescanned() = %+v, %v", found, ok)
+	}
+	if got := meter.Instances(); !slices.Equal(got, [][3]byte{EojSmartmeter}) {
+		t.Errorf("Instances() = %x", got)
+	}
+
+	// 最初の読み取りで換算に必要な値も読み出す
+	frame, err := meter.Get(ctx, 0xd3, 0xd7, 0xe1, 0xe0, 0xe7, 0xe8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, ok := meter.reading(frame, time.Now())
+	if !ok {
+		t.Fatal("no reading in the first response")
+	}
+	if scale, err := meter.CumulativeScale(); err != nil || scale != (CumulativeScale{Coefficient: 1, PowersOfTen: -1, Digits: 6}) {
+		t.Errorf("CumulativeScale() = %+v, %v", scale, err)
+	}
+	checkFloat(t, "first CumulativeKWh", first.CumulativeKWh, 12345.6)
+	checkFloat(t, "first AmpereR", first.AmpereR, 5.0)
+	checkFloat(t, "first AmpereT", first.AmpereT, 2.0)
+	if first.InstantWatt == nil || *first.InstantWatt != 500 {
+		t.Errorf("first InstantWatt = %v, want 500", first.InstantWatt)
+	}
+	if first.DeltaWh != nil {
+		t.Errorf("first DeltaWh = %v, want nil", *first.DeltaWh)
+	}
+	if first.Rssi != -60 {
+		t.Errorf("first Rssi = %d, want -60", first.Rssi)
+	}
+
+	// 2回目は逆潮流で、前回からの増分がある
+	frame, err = meter.Get(ctx, 0xe0, 0xe7, 0xe8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, ok := meter.reading(frame, time.Now())
+	if !ok {
+		t.Fatal("no reading in the second response")
+	}
+	if second.InstantWatt == nil || *second.InstantWatt != -300 {
+		t.Errorf("second InstantWatt = %v, want -300", second.InstantWatt)
+	}
+	checkFloat(t, "second AmpereR", second.AmpereR, -3.0)
+	checkFloat(t, "second CumulativeKWh", second.CumulativeKWh, 12346.1)
+	checkFloat(t, "second DeltaWh", second.DeltaWh, 500)
+
+	if err := meter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 記録の通りの順で要求コマンドが書き込まれた
+	var want []uint16
+	for _, step := range steps {
+		want = append(want, step.tx)
+	}
+	if got := writtenCommandCodes(port); !slices.Equal(got, want) {
+		t.Errorf("written commands = %04x, want %04x", got, want)
+	}
+	// 定時積算電力量計測値の通知(INF)はOnNotifyで登録した関数に届く
+	mu.Lock()
+	defer mu.Unlock()
+	var fixed []FixedTimeCumulative
+	for _, frame := range notified {
+		if v, err := valueOf(&EchonetliteFrame{esv: 0x72, edata: frame.edata}, 0xea); err == nil {
+			fixed = append(fixed, v.(FixedTimeCumulative))
+		}
+	}
+	wantFixed := FixedTimeCumulative{Time: time.Date(2025, 1, 2, 15, 30, 0, 0, MeterLocation), Value: 123450}
+	if len(fixed) != 1 || !fixed[0].Time.Equal(wantFixed.Time) || fixed[0].Value != wantFixed.Value {
+		t.Errorf("notified 0xea = %+v, want %+v", fixed, wantFixed)
+	}
+}
+
+// 接続するまで(testdata/connect.txt)、nameの記録、接続の終了(testdata/close.txt)の順に再生する
+// 接続したMeterと再生しているシリアルポート、全ての記録を返す
+func replayConnected(t *testing.T, name string) (*Meter, *fakeSerialPort, []sessionStep) {
+	t.Helper()
+	steps := slices.Concat(loadSession(t, "testdata/connect.txt"), loadSession(t, name), loadSession(t, "testdata/close.txt"))
+	port := replaySession(t, steps)
+	meter, err := NewMeter(port, Settings{
+		RouteBId:       "0123456789ABCDEF0123456789ABCDEF",
+		RouteBPassword: "abcdefghijkl",
+		Channel:        9,
+		MacAddress:     "001d129012345678",
+		PanId:          0x1234,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	meter.after = neverAfter
+	// 受信ゴルーチンはConnectのctxで動くのでテストが終わるまで取り消さない
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+	if err := meter.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return meter, port, steps
+}
+
+// Meterを閉じて、記録の通りの順で要求コマンドが書き込まれたことを確かめる
+func closeReplayed(t *testing.T, meter *Meter, port *fakeSerialPort, steps []sessionStep) {
+	t.Helper()
+	if err := meter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var want []uint16
+	for _, step := range steps {
+		want = append(want, step.tx)
+	}
+	if got := writtenCommandCodes(port); !slices.Equal(got, want) {
+		t.Errorf("written commands = %04x, want %04x", got, want)
+	}
+}
+
+// 送信したechonet lite電文のESV
+func writtenEsvs(port *fakeSerialPort) []byte {
+	port.mu.Lock()
+	defer port.mu.Unlock()
+	var esvs []byte
+	for _, b := range port.written {
+		if binary.BigEndian.Uint16(b[4:6]) != 0x0008 {
+			continue
+		}
+		// データ送信要求のデータ部は送信元IPv6アドレス、ポート番号、送信データ長(22バイト)に続いて送信データ
+		if frame, err := ParseEchonetliteFrame(b[J11DatagramHeaderBytes+22:]); err == nil {
+			esvs = append(esvs, frame.esv)
+		}
+	}
+	return esvs
+}
+
+func TestReconnect(t *testing.T) {
+	meter, port, steps := replayConnected(t, "testdata/reconnect.txt")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// 前のセッションを終了してからリセットせずに張り直す
+	if err := meter.Reconnect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := meter.Rescanned(); ok {
+		t.Error("Reconnect rescanned although authentication succeeded")
+	}
+	if got := meter.Instances(); !slices.Equal(got, [][3]byte{EojSmartmeter}) {
+		t.Errorf("Instances() = %x", got)
+	}
+	closeReplayed(t, meter, port, steps)
+}
+
+func TestGetProperties(t *testing.T) {
+	meter, port, steps := replayConnected(t, "testdata/properties.txt")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	props, err := meter.GetProperties(ctx, []byte{0x80, 0x8a, 0xe1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[byte][]byte{0x80: {0x30}, 0x8a: {0x00, 0x00, 0x16}, 0xe1: {0x01}}
+	if !maps.EqualFunc(props, want, bytes.Equal) {
+		t.Errorf("GetProperties() = %x, want %x", props, want)
+	}
+	// 不可応答(Get_SNA)で拒否された係数は含まない
+	props, err = meter.GetProperties(ctx, []byte{0x80, 0xd3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = map[byte][]byte{0x80: {0x30}}
+	if !maps.EqualFunc(props, want, bytes.Equal) {
+		t.Errorf("GetProperties() = %x, want %x", props, want)
+	}
+	closeReplayed(t, meter, port, steps)
+}
+
+func TestGetHistory(t *testing.T) {
+	meter, port, steps := replayConnected(t, "testdata/history.txt")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var want [48]uint32
+	for i := range want {
+		want[i] = 1000 + uint32(i)
+	}
+	want[47] = CumulativeNotAvailable
+	values, err := meter.GetHistory(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values != want {
+		t.Errorf("GetHistory(0) = %v, want %v", values, want)
+	}
+	// SetGet_SNAならSetCとGetでやり直す
+	for i := range want {
+		want[i] = 2000 + uint32(i)
+	}
+	values, err = meter.GetHistory(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values != want {
+		t.Errorf("GetHistory(1) = %v, want %v", values, want)
+	}
+	if got := writtenEsvs(port); !bytes.Equal(got, []byte{0x6e, 0x6e, 0x61, 0x62}) {
+		t.Errorf("written esv = %x, want SetGet, SetGet, SetC, Get", got)
+	}
+	closeReplayed(t, meter, port, steps)
+}
+
+func TestGetHistory2(t *testing.T) {
+	meter, port, steps := replayConnected(t, "testdata/history2.txt")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	at := time.Date(2025, 1, 2, 15, 30, 0, 0, MeterLocation)
+	history, err := meter.GetHistory2(ctx, at, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !history.Time.Equal(at) || !slices.Equal(history.Forward, []uint32{123456, 123450}) || !slices.Equal(history.Reverse, []uint32{100, 99}) {
+		t.Errorf("GetHistory2() = %+v", history)
+	}
+	// Getだけ拒否されたSetGet_SNAでもSetCとGetでやり直す
+	at = at.Add(-30 * time.Minute)
+	history, err = meter.GetHistory2(ctx, at, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !history.Time.Equal(at) || !slices.Equal(history.Forward, []uint32{123400}) || !slices.Equal(history.Reverse, []uint32{96}) {
+		t.Errorf("GetHistory2() = %+v", history)
+	}
+	if got := writtenEsvs(port); !bytes.Equal(got, []byte{0x6e, 0x6e, 0x61, 0x62}) {
+		t.Errorf("written esv = %x, want SetGet, SetGet, SetC, Get", got)
+	}
+	closeReplayed(t, meter, port, steps)
+}
+
+func TestSetGet(t *testing.T) {
+	meter, port, steps := replayConnected(t, "testdata/setget.txt")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	set := func(daysAgo byte) []EchonetliteEdata {
+		return []EchonetliteEdata{{epc: 0xe5, pdc: 1, edt: []byte{daysAgo}}}
+	}
+	frame, err := meter.SetGet(ctx, set(0), 0xe5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := valueOf(frame, 0xe5); err != nil || v != uint8(0) {
+		t.Errorf("0xe5 = %v, %v, want 0", v, err)
+	}
+	// 書き込みを拒否されたら応答とともにErrSetRefusedを返す
+	frame, err = meter.SetGet(ctx, set(7), 0xe5)
+	var refused *ErrSetRefused
+	if !errors.As(err, &refused) || !bytes.Equal(refused.Epcs, []byte{0xe5}) {
+		t.Errorf("SetGet() error = %v, want ErrSetRefused for 0xe5", err)
+	}
+	if frame == nil || frame.esv != 0x5e {
+		t.Errorf("SetGet() frame = %+v, want SetGet_SNA", frame)
+	}
+	// 読み出しだけ拒否されたらエラーにせず、値がErrPropertyNotAvailableになる
+	frame, err = meter.SetGet(ctx, set(2), 0xe2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var notAvailable *ErrPropertyNotAvailable
+	if _, err := valueOf(frame, 0xe2); !errors.As(err, &notAvailable) || notAvailable.Epc != 0xe2 {
+		t.Errorf("0xe2 error = %v, want ErrPropertyNotAvailable", err)
+	}
+	closeReplayed(t, meter, port, steps)
+}
+
+func TestGetCumulativeBoth(t *testing.T) {
+	meter, port, steps := replayConnected(t, "testdata/cumulative_both.txt")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// 係数10、単位0.1kWh
+	forward, reverse, err := meter.GetCumulativeBoth(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFloat(t, "forward", &forward, 123456)
+	checkFloat(t, "reverse", &reverse, 100)
+	// 逆方向を拒否されたらErrPropertyNotAvailable
+	_, _, err = meter.GetCumulativeBoth(ctx)
+	var notAvailable *ErrPropertyNotAvailable
+	if !errors.As(err, &notAvailable) || notAvailable.Epc != 0xe3 {
+		t.Errorf("GetCumulativeBoth() error = %v, want ErrPropertyNotAvailable for 0xe3", err)
+	}
+	closeReplayed(t, meter, port, steps)
+}
+
+func TestStream(t *testing.T) {
+	meter, port, steps := replayConnected(t, "testdata/stream.txt")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// 最初の読み取りだけを受け取る
+	readings, errs := meter.Stream(ctx, time.Hour)
+	var reading Reading
+	select {
+	case reading = <-readings:
+	case err := <-errs:
+		t.Fatal(err)
+	}
+	cancel()
+	// 読み取りが止まってから閉じる
+	for range readings {
+	}
+	for range errs {
+	}
+	// 係数の無いスマートメーターでも単位で換算する
+	if scale, err := meter.CumulativeScale(); err != nil || scale != (CumulativeScale{Coefficient: 1, PowersOfTen: -1, Digits: 6}) {
+		t.Errorf("CumulativeScale() = %+v, %v", scale, err)
+	}
+	if reading.InstantWatt == nil || *reading.InstantWatt != 500 {
+		t.Errorf("InstantWatt = %v, want 500", reading.InstantWatt)
+	}
+	checkFloat(t, "AmpereR", reading.AmpereR, 5.0)
+	checkFloat(t, "AmpereT", reading.AmpereT, 2.0)
+	checkFloat(t, "CumulativeKWh", reading.CumulativeKWh, 12345.6)
+	closeReplayed(t, meter, port, steps)
+}
+
+// 浮動小数点数の計測値を比べる
+func checkFloat(t *testing.T, name string, got *float64, want float64) {
+	t.Helper()
+	if got == nil {
+		t.Errorf("%s = nil, want %v", name, want)
+		return
+	}
+	if diff := *got - want; diff < -1e-9 || 1e-9 < diff {
+		t.Errorf("%s = %v, want %v", name, *got, want)
+	}
+}
+
+func TestConnEchonetliteReadShort(t *testing.T) {
+	// データ受信通知のデータ部(受信データは瞬時電力計測値のGet_res)
+	full := append(mustDecodeHex(t, "fe80 0000 0000 0000 021d 1290 1234 5678 0e1a 0e1a 1234 00 02 c4 0012"),
+		mustDecodeHex(t, getResInstantWatt)...)
+	// 受信データサイズまで揃っていない短いデータ受信通知はパニックせずにErrMalformedDataを返す
+	for _, n := range []int{0, 1, 16, 19, 20, 24, 26} {
+		rxNotify := make(chan J11Datagram, 1)
+		conn := NewConnEchonetlite(io.Discard, netip.IPv6LinkLocalAllNodes(), 0x0e1a, 0x0e1a, rxNotify)
+		rxNotify <- J11Datagram{Header: J11DatagramHeader{CommandCode: 0x6018}, Data: full[:n]}
+		b := make([]byte, 256)
+		if got, err := conn.Read(b); !errors.Is(err, ErrMalformedData) {
+			t.Errorf("%d bytes: Read() = %d, %v, want ErrMalformedData", n, got, err)
+		}
+	}
+	// 揃っていれば受信データを読める
+	rxNotify := make(chan J11Datagram, 1)
+	conn := NewConnEchonetlite(io.Discard, netip.IPv6LinkLocalAllNodes(), 0x0e1a, 0x0e1a, rxNotify)
+	rxNotify <- J11Datagram{Header: J11DatagramHeader{CommandCode: 0x6018}, Data: full}
+	b := make([]byte, 256)
+	n, err := conn.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := mustDecodeHex(t, getResInstantWatt); !bytes.Equal(b[:n], want) {
+		t.Errorf("Read() = %x, want %x", b[:n], want)
+	}
+	if conn.rssi != -60 {
+		t.Errorf("rssi = %d, want -60", conn.rssi)
+	}
+}
+
+func TestLinkLocalFromMac(t *testing.T) {
+	tests := []struct {
+		mac  uint64
+		want string
+	}{
+		{0x001d129012345678, "fe80::21d:1290:1234:5678"},
+		// U/Lビットが立っていれば落とす
+		{0x021d129012345678, "fe80::1d:1290:1234:5678"},
+		// U/Lビット以外は変えない
+		{0xfdffffffffffffff, "fe80::ffff:ffff:ffff:ffff"},
+		{0, "fe80::200:0:0:0"},
+	}
+	for _, tt := range tests {
+		got := LinkLocalFromMac(tt.mac)
+		if want := netip.MustParseAddr(tt.want); got != want {
+			t.Errorf("LinkLocalFromMac(%016x) = %v, want %v", tt.mac, got, want)
+		}
+		if !got.IsLinkLocalUnicast() {
+			t.Errorf("LinkLocalFromMac(%016x) = %v is not link-local", tt.mac, got)
+		}
+	}
+}
+
+func TestParseNotifyActivescan(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		ok   bool
+		want notifyActivescan
+	}{
+		{"短すぎる", "00", false, notifyActivescan{}},
+		{"Beacon応答無し", "01 04", true, notifyActivescan{result: 1, channel: 4}},
+		{"Beacon応答の情報が足りない", "00 09 01 001d1290123456", true, notifyActivescan{result: 0, channel: 9}},
+		{
+			"Beacon応答あり", "00 09 01 001d129012345678 1234 c4", true,
+			notifyActivescan{result: 0, channel: 9, count: 1, beacons: []BeaconResponse{
+				{channel: 9, macAddress: 0x001d129012345678, panId: 0x1234, rssi: -60},
+			}},
+		},
+		{
+			"スキャン数の分だけ並んでいる", "00 0a 02 001d129012345678 1234 c4 001d129087654321 4321 b0", true,
+			notifyActivescan{result: 0, channel: 10, count: 2, beacons: []BeaconResponse{
+				{channel: 10, macAddress: 0x001d129012345678, panId: 0x1234, rssi: -60},
+				{channel: 10, macAddress: 0x001d129087654321, panId: 0x4321, rssi: -80},
+			}},
+		},
+		{
+			"スキャン数より少ない", "00 0a 03 001d129012345678 1234 c4 001d1290876543", true,
+			notifyActivescan{result: 0, channel: 10, count: 3, beacons: []BeaconResponse{
+				{channel: 10, macAddress: 0x001d129012345678, panId: 0x1234, rssi: -60},
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseNotifyActivescan(J11Datagram{Data: mustDecodeHex(t, tt.data)})
+			if ok != tt.ok || got.result != tt.want.result || got.channel != tt.want.channel ||
+				got.count != tt.want.count || !slices.Equal(got.beacons, tt.want.beacons) {
+				t.Errorf("parseNotifyActivescan() = %+v, %v, want %+v, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+// 任意のアクティブスキャン通知を与えてもパニックしない
+func FuzzParseNotifyActivescan(f *testing.F) {
+	f.Add(mustDecodeHex(f, "01 04"))
+	f.Add(mustDecodeHex(f, "00 09 01 001d129012345678 1234 c4"))
+	f.Add(mustDecodeHex(f, "00 0a 02 001d129012345678 1234 c4 001d129087654321 4321 b0"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		notify, ok := parseNotifyActivescan(J11Datagram{Data: data})
+		if !ok {
+			return
+		}
+		if len(notify.beacons) > notify.count {
+			t.Errorf("%d beacons but count=%d", len(notify.beacons), notify.count)
+		}
+		for _, b := range notify.beacons {
+			if b.channel != notify.channel {
+				t.Errorf("beacon channel %d, want %d", b.channel, notify.channel)
+			}
+		}
+	})
+}
+
+func TestConcurrentReport(t *testing.T) {
+	// 読み取りループ(応答)と受信ゴルーチン(通知)から同時に出力しても競合しない
+	// go test -raceで確かめる
+	meter, err := NewMeter(newFakeSerialPort(), Settings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer meter.Close()
+	scaleRes, err := ParseEchonetliteFrame(mustDecodeHex(t, "1081 0001 028801 05ff01 72 03 d3 04 00000001 d7 01 06 e1 01 01"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	getRes, err := ParseEchonetliteFrame(mustDecodeHex(t, "1081 0002 028801 05ff01 72 02 e0 04 0001e240 e7 04 000001f4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	inf, err := ParseEchonetliteFrame(mustDecodeHex(t, "1081 0000 028801 05ff01 73 01 ea 0b 07e9 01 02 0f 1e 00 0001e23a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	meter.remember(scaleRes)
+	var buf bytes.Buffer
+	report := serializeReport(withSink(context.Background(), func(*EchonetliteFrame) {}, NewCSVSink(&buf), meter))
+	const n = 200
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() { // 応答を受け取る要求(換算を覚える)
+		defer wg.Done()
+		for range n {
+			meter.remember(scaleRes)
+		}
+	}()
+	go func() { // 読み取りループ
+		defer wg.Done()
+		for range n {
+			report(getRes)
+		}
+	}()
+	go func() { // 受信ゴルーチン
+		defer wg.Done()
+		for range n {
+			report(inf)
+		}
+	}()
+	wg.Wait()
+	// 行が混ざらずに見出しと全ての計測値が出力される
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1+2*n {
+		t.Errorf("%d records, want %d", len(records), 1+2*n)
+	}
+}
+
+func TestDiscardNotifications(t *testing.T) {
+	meter, err := NewMeter(newFakeSerialPort(), Settings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer meter.Close()
+	// 最初のリセット要求の後、待つのをやめてから届いた起動完了通知
+	meter.rxNotifyChan <- J11Datagram{Header: J11DatagramHeader{CommandCode: 0x6019}, Data: []byte{0x02}}
+	meter.rxNotifyChan <- J11Datagram{Header: J11DatagramHeader{CommandCode: 0x6029}}
+	meter.discardNotifications()
+	if n := len(meter.rxNotifyChan); n != 0 {
+		t.Errorf("%d notifications left", n)
+	}
+}
+
+func TestResetAgain(t *testing.T) {
+	// 最初のリセット要求に起動完了通知が無ければもう一度リセット要求を出して、その起動完了通知を待つ
+	port := newFakeSerialPort()
+	meter, err := NewMeter(port, Settings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer meter.Close()
+	timeout := make(chan time.Time)
+	close(timeout)
+	calls := 0
+	meter.after = func(time.Duration) <-chan time.Time {
+		calls++
+		if calls == 1 {
+			return timeout // 最初の待ちは起動完了通知無しで終わる
+		}
+		return nil
+	}
+	port.respond = func(b []byte) []byte {
+		if len(port.written) == 2 {
+			return responseBytes(0x6019, []byte{0x02})
+		}
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := meter.reset(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := writtenCommandCodes(port); !slices.Equal(got, []uint16{0x00d9, 0x00d9}) {
+		t.Errorf("written commands = %04x, want two hardware resets", got)
+	}
+}
+
+func TestRequestTimeoutNotExtended(t *testing.T) {
+	// 他の要求に対する応答を受け取っても待ち時間は最初に決めたまま
+	port := newFakeSerialPort()
+	meter, err := NewMeter(port, Settings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer meter.Close()
+	timeout := make(chan time.Time)
+	var (
+		mu    sync.Mutex
+		calls int
+	)
+	meter.after = func(time.Duration) <-chan time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		return timeout
+	}
+	port.respond = func(b []byte) []byte {
+		return responseBytes(0x2008, []byte{0x01, 0x00}) // データ送信成功
+	}
+	meter.conn = NewConnEchonetlite(port, LinkLocalFromMac(0x001d129012345678), EchonetLitePort, EchonetLitePort, meter.rxNotifyChan)
+	// 受信ゴルーチンの代わりにテストから電文を渡す
+	meter.rxFrameChan = make(chan *EchonetliteFrame)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	errc := make(chan error, 1)
+	go func() {
+		_, err := meter.Get(ctx, 0xe7)
+		errc <- err
+	}()
+	for tid := range uint16(3) {
+		meter.rxFrameChan <- &EchonetliteFrame{ehd: 0x1081, tid: 0x8000 + tid, esv: 0x72}
+	}
+	close(timeout)
+	if err := <-errc; !errors.Is(err, ErrUartReadTimeoutExceeded) {
+		t.Fatalf("Get() error = %v, want ErrUartReadTimeoutExceeded", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	// データ送信要求応答(0x2008)の待ちと応答の待ちで1回ずつ
+	if calls != 2 {
+		t.Errorf("after called %d times, want 2", calls)
+	}
+}
+
+func TestCumulativeDeltaWhWrap(t *testing.T) {
+	meter, err := NewMeter(newFakeSerialPort(), Settings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer meter.Close()
+	// 係数1, 有効桁数6, 単位0.1kWh
+	scaleRes, err := ParseEchonetliteFrame(mustDecodeHex(t, "1081 0001 028801 05ff01 72 03 d3 04 00000001 d7 01 06 e1 01 01"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	meter.remember(scaleRes)
+	t0 := time.Date(2025, 1, 2, 15, 0, 0, 0, time.UTC)
+	steps := []struct {
+		raw  uint64
+		at   time.Time
+		want float64
+		ok   bool
+	}{
+		{999990, t0, 0, false},                       // 初回
+		{999999, t0.Add(time.Minute), 900, true},     // 0.9kWh
+		{5, t0.Add(2 * time.Minute), 600, true},      // 999999から一周して6増えた
+		{4, t0.Add(time.Minute), 0, false},           // 前回より古い計測値
+		{15, t0.Add(3 * time.Minute), 1000, true},    // 古い計測値は前回として覚えない
+		{1000000, t0.Add(4 * time.Minute), 0, false}, // 有効桁数を超えた計測値
+	}
+	for i, step := range steps {
+		got, ok := meter.CumulativeDeltaWh(step.raw, step.at)
+		if ok != step.ok || (ok && math.Abs(got-step.want) > 1e-6) {
+			t.Errorf("step %d: CumulativeDeltaWh(%d) = %v, %v, want %v, %v", i, step.raw, got, ok, step.want, step.ok)
+		}
+	}
+}
+
+func TestReadingFixedTimeDelta(t *testing.T) {
+	// 定時積算電力量計測値(0xea)はスマートメーターの時刻なので、受信日時で数える増分の計算に混ぜない
+	meter, err := NewMeter(newFakeSerialPort(), Settings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer meter.Close()
+	scaleRes, err := ParseEchonetliteFrame(mustDecodeHex(t, "1081 0001 028801 05ff01 72 03 d3 04 00000001 d7 01 06 e1 01 01"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	meter.remember(scaleRes)
+	get := func(raw string) *EchonetliteFrame {
+		frame, err := ParseEchonetliteFrame(mustDecodeHex(t, "1081 0002 028801 05ff01 72 01 e0 04"+raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return frame
+	}
+	// 受信日時より進んでいるスマートメーターの時刻の通知
+	inf, err := ParseEchonetliteFrame(mustDecodeHex(t, "1081 0000 028801 05ff01 73 01 ea 0b 07e9 01 02 0f 1e 00 0001e23a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2025, 1, 2, 15, 20, 0, 0, MeterLocation)
+	steps := []struct {
+		name  string
+		frame *EchonetliteFrame
+		at    time.Time
+		delta *float64
+	}{
+		{"初回", get("0001e240"), now, nil},
+		{"定時積算電力量", inf, now.Add(time.Minute), nil},
+		{"定時積算電力量の後", get("0001e245"), now.Add(2 * time.Minute), ptr(500.0)},
+		{"次の読み取り", get("0001e246"), now.Add(3 * time.Minute), ptr(100.0)},
+	}
+	for _, step := range steps {
+		r, ok := meter.reading(step.frame, step.at)
+		if !ok {
+			t.Fatalf("%s: no reading", step.name)
+		}
+		if step.delta == nil {
+			if r.DeltaWh != nil {
+				t.Errorf("%s: DeltaWh = %v, want nil", step.name, *r.DeltaWh)
+			}
+			continue
+		}
+		checkFloat(t, step.name+" DeltaWh", r.DeltaWh, *step.delta)
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
@@ -0,0 +1,172 @@
+// BP35Cx-J11を使ってスマートメータから電力消費量などを得る
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 Akihiro Yamamoto <github.com/ak1211>
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prometheusで公開する計測値
+// initで一度だけ登録する
+var (
+	metricInstantWatt = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "smartmeter_instant_watt",
+		Help: "Instantaneous electric power in watts (EPC 0xe7).",
+	})
+	metricInstantAmpereR = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "smartmeter_instant_ampere_r",
+		Help: "Instantaneous current of R phase in amperes (EPC 0xe8).",
+	})
+	metricInstantAmpereT = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "smartmeter_instant_ampere_t",
+		Help: "Instantaneous current of T phase in amperes (EPC 0xe8).",
+	})
+	metricCumulativeWh = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "smartmeter_cumulative_wh",
+		Help: "Cumulative amount of electric energy in watt-hours (EPC 0xe0 scaled by 0xd3 and 0xe1).",
+	})
+	metricRssi = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "smartmeter_rssi_dbm",
+		Help: "RSSI of the most recently received datagram in dBm.",
+	})
+	metricReadErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "smartmeter_read_errors_total",
+		Help: "Number of failed or not available readings.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		metricInstantWatt,
+		metricInstantAmpereR,
+		metricInstantAmpereT,
+		metricCumulativeWh,
+		metricRssi,
+		metricReadErrors,
+	)
+}
+
+// 連続読み取りの状態
+type Status struct {
+	mu          sync.Mutex
+	connected   bool
+	lastRead    time.Time
+	rssi        int8
+	reauthCount int
+}
+
+var daemonStatus = &Status{}
+
+// 接続状態を設定する
+func (s *Status) SetConnected(connected bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.connected = connected
+}
+
+// 読み取りに成功した日時とそのときのRSSIを記録する
+func (s *Status) ReadSucceeded(t time.Time, rssi int8) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastRead = t
+	s.rssi = rssi
+}
+
+// PANA認証をやり直した回数を記録する
+func (s *Status) SetReauthCount(count int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reauthCount = count
+}
+
+// /statusで返すJSON
+type statusResponse struct {
+	Connected   bool       `json:"connected"`
+	LastRead    *time.Time `json:"last_read,omitempty"` // まだ読み取っていなければ無し
+	Rssi        int8       `json:"rssi"`
+	ReauthCount int        `json:"reauth_count"`
+}
+
+// 状態をJSONで返す
+// 接続していなければ503を返すので死活監視に使える
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	daemonStatus.mu.Lock()
+	resp := statusResponse{
+		Connected:   daemonStatus.connected,
+		Rssi:        daemonStatus.rssi,
+		ReauthCount: daemonStatus.reauthCount,
+	}
+	if !daemonStatus.lastRead.IsZero() {
+		lastRead := daemonStatus.lastRead
+		resp.LastRead = &lastRead
+	}
+	daemonStatus.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if !resp.Connected {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// 受信したechonet lite電文で計測値を更新する
+// 値が無い場合は前の値のままにしてエラー数を数える
+// 積算電力量計測値はscaleで換算する
+func updateMetrics(frame *EchonetliteFrame, scale CumulativeScale, scaleErr error) {
+	for _, edata := range frame.edata {
+		switch edata.epc {
+		case 0xe0, 0xe7, 0xe8:
+		default:
+			continue
+		}
+		v, err := edata.Value()
+		if err != nil {
+			metricReadErrors.Add(1)
+			continue
+		}
+		switch v := v.(type) {
+		case uint64: // 0xe0
+			if scaleErr != nil {
+				metricReadErrors.Add(1)
+				continue
+			}
+			metricCumulativeWh.Set(scale.KWh(v) * 1000)
+		case int32: // 0xe7
+			metricInstantWatt.Set(float64(v))
+		case InstantCurrent: // 0xe8
+			metricInstantAmpereR.Set(v.RAmpere())
+			if t, ok := v.TAmpere(); ok {
+				metricInstantAmpereT.Set(t)
+			}
+		}
+	}
+}
+
+// 中断されるまで計測値をHTTPで公開する
+func serveMetrics(ctx context.Context, addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/status", handleStatus)
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	slog.Info("serve metrics", slog.String("addr", addr))
+	err := server.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,206 @@
+// BP35Cx-J11を使ってスマートメータから電力消費量などを得る
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 Akihiro Yamamoto <github.com/ak1211>
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// 出力形式
+const (
+	OutputText = "text" // slogで表示する
+	OutputJSON = "json" // 1行に1つのJSONオブジェクトを出力する
+)
+
+// 1つの計測値
+type Measurement struct {
+	Epc       string    `json:"epc"`              // EPC(例: "0xe7")
+	Name      string    `json:"name"`             // 計測値の名前
+	Raw       any       `json:"raw"`              // 解釈した値
+	Value     *float64  `json:"value,omitempty"`  // 単位を付けた値
+	Unit      string    `json:"unit,omitempty"`   // 単位
+	Wiring    string    `json:"wiring,omitempty"` // 配線方式(瞬時電流計測値のみ 例: "1φ3W")
+	Timestamp time.Time `json:"timestamp"`        // 受信日時
+}
+
+// echonet lite電文から計測値を取り出す
+// 解釈できない値は含めない
+// scaleがnilでなければ積算電力量計測値をkWhに換算する
+func Measurements(frame *EchonetliteFrame, timestamp time.Time, scale *CumulativeScale) []Measurement {
+	var ms []Measurement
+	// SetGet応答ではGet側のプロパティに読み出した値がある
+	for _, edata := range slices.Concat(frame.edata, frame.getEdata) {
+		v, err := edata.Value()
+		if err != nil {
+			continue
+		}
+		m := Measurement{
+			Epc:       fmt.Sprintf("0x%02x", edata.epc),
+			Raw:       v,
+			Timestamp: timestamp,
+		}
+		value := func(f float64, unit string) {
+			m.Value = &f
+			m.Unit = unit
+		}
+		switch edata.epc {
+		case 0x80:
+			m.Name = "operation_status"
+		case 0x82:
+			m.Name = "standard_version"
+		case 0x88:
+			m.Name = "fault_status"
+		case 0x8a:
+			m.Name = "manufacturer_code"
+		case 0x8c:
+			m.Name = "product_code"
+		case 0x8d:
+			m.Name = "serial_number"
+		case 0x8e:
+			m.Name = "production_date"
+		case 0x97:
+			m.Name = "current_time"
+		case 0x98:
+			m.Name = "current_date"
+		case 0x9d:
+			m.Name = "announce_property_map"
+		case 0x9e:
+			m.Name = "set_property_map"
+		case 0x9f:
+			m.Name = "get_property_map"
+		case 0xd3:
+			m.Name = "coefficient"
+			value(float64(v.(uint32)), "")
+		case 0xd5:
+			m.Name = "instance_list"
+		case 0xd6:
+			m.Name = "self_node_instance_list"
+		case 0xd7:
+			m.Name = "cumulative_digits"
+			value(float64(v.(uint8)), "")
+		case 0xe0:
+			m.Name = "cumulative_forward"
+			if scale != nil {
+				value(scale.KWh(v.(uint64)), "kWh")
+			}
+		case 0xe1:
+			m.Name = "cumulative_unit"
+		case 0xe2:
+			m.Name = "cumulative_history_forward"
+		case 0xe3:
+			m.Name = "cumulative_reverse"
+			if scale != nil {
+				value(scale.KWh(v.(uint64)), "kWh")
+			}
+		case 0xe4:
+			m.Name = "cumulative_history_reverse"
+		case 0xe5:
+			m.Name = "history_collection_day"
+			value(float64(v.(uint8)), "day")
+		case 0xe7:
+			m.Name = "instant_watt"
+			value(float64(v.(int32)), "W")
+		case 0xe8:
+			current := v.(InstantCurrent)
+			m.Name = "instant_ampere_r"
+			m.Wiring = current.Wiring().String()
+			value(current.RAmpere(), "A")
+			if t, ok := current.TAmpere(); ok {
+				ms = append(ms, m)
+				m = Measurement{
+					Epc:       m.Epc,
+					Name:      "instant_ampere_t",
+					Raw:       v,
+					Wiring:    m.Wiring,
+					Timestamp: timestamp,
+				}
+				value(t, "A")
+			}
+		case 0xea:
+			m.Name = "fixed_time_cumulative_forward"
+		case 0xec:
+			m.Name = "cumulative_history_2"
+		case 0xed:
+			m.Name = "history_collection_time_2"
+		default:
+			m.Name = "unknown"
+		}
+		ms = append(ms, m)
+	}
+	return ms
+}
+
+// 計測値を1行のログにまとめる属性を返す
+// 単位を付けた値があればそれを(例: instant_watt=420W)、無ければ解釈した値を使う
+// structuredなら単位を付けた値を文字列にせず、数値と単位に分ける(例: "instant_watt":{"value":420,"unit":"W"})
+func Summary(ms []Measurement, structured bool) []any {
+	attrs := make([]any, 0, len(ms))
+	for _, m := range ms {
+		switch {
+		case m.Value != nil && structured && m.Unit != "":
+			attrs = append(attrs, slog.Group(m.Name, slog.Float64("value", *m.Value), slog.String("unit", m.Unit)))
+		case m.Value != nil && structured:
+			attrs = append(attrs, slog.Float64(m.Name, *m.Value))
+		case m.Value != nil:
+			attrs = append(attrs, slog.String(m.Name, strconv.FormatFloat(*m.Value, 'f', -1, 64)+m.Unit))
+		default:
+			attrs = append(attrs, slog.Any(m.Name, m.Raw))
+		}
+	}
+	return attrs
+}
+
+// 不可応答で拒否されたEPCを知らせる
+// プロパティ毎の表示が無いinfoレベルでも、--greetingから外すプロパティが分かるようにする
+func warnRefusedEpcs(frame *EchonetliteFrame) {
+	if refused := frame.RefusedEpcs(); len(refused) > 0 {
+		slog.Warn("refused", slog.String("esv", fmt.Sprintf("0x%02x", frame.esv)), slog.String("epcs", formatEpcs(refused)))
+	}
+}
+
+// 出力形式に応じてechonet lite電文を出力する関数を返す
+// 積算電力量計測値はmeterの換算でkWhに換算する
+func newReporter(output string, w io.Writer, meter *Meter) (func(*EchonetliteFrame), error) {
+	switch output {
+	case OutputText:
+		return func(frame *EchonetliteFrame) {
+			// プロパティ毎の表示はdebugレベルのときだけ
+			if slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+				frame.Show()
+			}
+			warnRefusedEpcs(frame)
+			var scale *CumulativeScale
+			if s, err := meter.CumulativeScale(); err == nil {
+				scale = &s
+			}
+			ms := Measurements(frame, time.Now(), scale)
+			if len(ms) > 0 {
+				slog.Info("summary", Summary(ms, structuredLog)...)
+			}
+		}, nil
+	case OutputJSON:
+		encoder := json.NewEncoder(w)
+		return func(frame *EchonetliteFrame) {
+			warnRefusedEpcs(frame)
+			var scale *CumulativeScale
+			if s, err := meter.CumulativeScale(); err == nil {
+				scale = &s
+			}
+			for _, m := range Measurements(frame, time.Now(), scale) {
+				if err := encoder.Encode(m); err != nil {
+					slog.Error("Encode", "err", err)
+				}
+			}
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown output format: %s", output)
+	}
+}
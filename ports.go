@@ -0,0 +1,92 @@
+// BP35Cx-J11を使ってスマートメータから電力消費量などを得る
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 Akihiro Yamamoto <github.com/ak1211>
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// シリアルデバイスの情報
+// USB機器の情報が得られなければ空にする
+type SerialPortInfo struct {
+	Name         string // --deviceに指定する名前(例: /dev/ttyUSB0, COM3)
+	VendorId     string // USBベンダーID(例: "0403")
+	ProductId    string // USBプロダクトID
+	Manufacturer string // USB機器の製造者名
+	Product      string // USB機器の製品名
+	SerialNumber string // USB機器のシリアル番号
+}
+
+// USB機器ならtrue
+func (p SerialPortInfo) IsUsb() bool {
+	return p.VendorId != ""
+}
+
+// BP35Cxらしい機器ならtrue
+// 製造者名か製品名にROHMかBP35が含まれていれば候補とする
+func (p SerialPortInfo) LooksLikeBP35() bool {
+	s := strings.ToLower(p.Manufacturer + " " + p.Product)
+	return strings.Contains(s, "rohm") || strings.Contains(s, "bp35")
+}
+
+// シリアルデバイス名を末尾の番号の順に並べる比較関数
+// 文字列のまま比べるとCOM10がCOM3より前に、ttyUSB10がttyUSB2より前になってしまう
+// 番号を除いた名前が違えば名前順にする
+func comparePortNames(a, b string) int {
+	aPrefix, aNum := splitPortNumber(a)
+	bPrefix, bNum := splitPortNumber(b)
+	if c := strings.Compare(aPrefix, bPrefix); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(aNum, bNum); c != 0 {
+		return c
+	}
+	return strings.Compare(a, b)
+}
+
+// シリアルデバイス名を末尾の番号とそれより前に分ける(番号が無ければ-1)
+func splitPortNumber(name string) (string, int) {
+	i := len(name)
+	for i > 0 && '0' <= name[i-1] && name[i-1] <= '9' {
+		i--
+	}
+	n, err := strconv.Atoi(name[i:])
+	if err != nil {
+		return name, -1
+	}
+	return name[:i], n
+}
+
+// シリアルデバイスの一覧を表示する
+func ports(w io.Writer) error {
+	list, err := listSerialPorts()
+	if err != nil {
+		return err
+	}
+	if len(list) == 0 {
+		fmt.Fprintln(w, "シリアルデバイスが見つかりません")
+		return nil
+	}
+	for _, p := range list {
+		line := p.Name
+		if p.IsUsb() {
+			line += fmt.Sprintf("\tUSB %s:%s", p.VendorId, p.ProductId)
+			if p.Manufacturer != "" || p.Product != "" {
+				line += fmt.Sprintf(" %s %s", p.Manufacturer, p.Product)
+			}
+			if p.SerialNumber != "" {
+				line += " serial=" + p.SerialNumber
+			}
+		}
+		if p.LooksLikeBP35() {
+			line += "\t(BP35Cx?)"
+		}
+		fmt.Fprintln(w, strings.TrimRight(line, " "))
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+// BP35Cx-J11を使ってスマートメータから電力消費量などを得る
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 Akihiro Yamamoto <github.com/ak1211>
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// 既定のシリアルデバイス名
+const DefaultSerialDevice = "/dev/ttyUSB0"
+
+// /sys/class/ttyからシリアルデバイスを探す
+// 実体の無いシリアルポート(serial8250)は除く
+// USB機器なら親をたどってUSBディスクリプタの情報を読む
+func listSerialPorts() ([]SerialPortInfo, error) {
+	entries, err := os.ReadDir("/sys/class/tty")
+	if err != nil {
+		return nil, err
+	}
+	var list []SerialPortInfo
+	for _, entry := range entries {
+		dir := filepath.Join("/sys/class/tty", entry.Name())
+		device, err := filepath.EvalSymlinks(filepath.Join(dir, "device"))
+		if err != nil {
+			continue // 仮想端末
+		}
+		if driver, err := filepath.EvalSymlinks(filepath.Join(device, "driver")); err == nil && filepath.Base(driver) == "serial8250" {
+			continue
+		}
+		p := SerialPortInfo{Name: filepath.Join("/dev", entry.Name())}
+		for d := device; d != "/" && d != "."; d = filepath.Dir(d) {
+			if vendor := readSysfs(d, "idVendor"); vendor != "" {
+				p.VendorId = vendor
+				p.ProductId = readSysfs(d, "idProduct")
+				p.Manufacturer = readSysfs(d, "manufacturer")
+				p.Product = readSysfs(d, "product")
+				p.SerialNumber = readSysfs(d, "serial")
+				break
+			}
+		}
+		list = append(list, p)
+	}
+	slices.SortFunc(list, func(a, b SerialPortInfo) int { return comparePortNames(a.Name, b.Name) })
+	return list, nil
+}
+
+// sysfsの属性を読む(無ければ空)
+func readSysfs(dir, name string) string {
+	b, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
@@ -0,0 +1,34 @@
+// BP35Cx-J11を使ってスマートメータから電力消費量などを得る
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 Akihiro Yamamoto <github.com/ak1211>
+
+//go:build !linux && !windows
+
+package main
+
+import (
+	"path/filepath"
+	"slices"
+)
+
+// 既定のシリアルデバイス名
+const DefaultSerialDevice = "/dev/ttyUSB0"
+
+// /devからシリアルデバイスらしい名前を探す
+// USB機器の情報は得られない
+func listSerialPorts() ([]SerialPortInfo, error) {
+	var names []string
+	for _, pattern := range []string{"/dev/cu.*", "/dev/ttyU*", "/dev/cuaU*"} {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, matches...)
+	}
+	slices.SortFunc(names, comparePortNames)
+	list := make([]SerialPortInfo, len(names))
+	for i, name := range names {
+		list[i] = SerialPortInfo{Name: name}
+	}
+	return list, nil
+}
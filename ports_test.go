@@ -0,0 +1,30 @@
+// BP35Cx-J11を使ってスマートメータから電力消費量などを得る
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 Akihiro Yamamoto <github.com/ak1211>
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestComparePortNames(t *testing.T) {
+	tests := []struct {
+		names []string
+		want  []string
+	}{
+		{[]string{"COM10", "COM3", "COM1", "COM2"}, []string{"COM1", "COM2", "COM3", "COM10"}},
+		{[]string{"/dev/ttyUSB10", "/dev/ttyUSB2", "/dev/ttyACM0", "/dev/ttyUSB0"}, []string{"/dev/ttyACM0", "/dev/ttyUSB0", "/dev/ttyUSB2", "/dev/ttyUSB10"}},
+		// 番号の無い名前も名前順に並ぶ
+		{[]string{"/dev/cu.usbserial-A1", "/dev/cu.usbserial", "/dev/cu.Bluetooth"}, []string{"/dev/cu.Bluetooth", "/dev/cu.usbserial", "/dev/cu.usbserial-A1"}},
+		// 番号の前の0は番号が同じなら名前順
+		{[]string{"COM01", "COM1", "COM002"}, []string{"COM01", "COM1", "COM002"}},
+	}
+	for _, tt := range tests {
+		got := slices.Clone(tt.names)
+		slices.SortFunc(got, comparePortNames)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("sorted %q = %q, want %q", tt.names, got, tt.want)
+		}
+	}
+}
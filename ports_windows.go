@@ -0,0 +1,43 @@
+// BP35Cx-J11を使ってスマートメータから電力消費量などを得る
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 Akihiro Yamamoto <github.com/ak1211>
+package main
+
+import (
+	"errors"
+	"slices"
+	"syscall"
+
+	"golang.org/x/sys/windows/registry"
+)
+
+// 既定のシリアルデバイス名
+// COM番号は環境によって変わるのでportsで確認して--deviceで指定する
+const DefaultSerialDevice = "COM3"
+
+// レジストリのHKLM\HARDWARE\DEVICEMAP\SERIALCOMMからCOMポートを探す
+// USB機器の情報は得られない
+func listSerialPorts() ([]SerialPortInfo, error) {
+	key, err := registry.OpenKey(registry.LOCAL_MACHINE, `HARDWARE\DEVICEMAP\SERIALCOMM`, registry.QUERY_VALUE)
+	if errors.Is(err, syscall.ERROR_FILE_NOT_FOUND) {
+		return nil, nil // COMポートが1つも無いとキーが無い
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer key.Close()
+	names, err := key.ReadValueNames(0)
+	if err != nil {
+		return nil, err
+	}
+	var list []SerialPortInfo
+	for _, name := range names {
+		port, _, err := key.GetStringValue(name)
+		if err != nil {
+			continue
+		}
+		list = append(list, SerialPortInfo{Name: port})
+	}
+	slices.SortFunc(list, func(a, b SerialPortInfo) int { return comparePortNames(a.Name, b.Name) })
+	return list, nil
+}
@@ -0,0 +1,302 @@
+// BP35Cx-J11を使ってスマートメータから電力消費量などを得る
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: 2025 Akihiro Yamamoto <github.com/ak1211>
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 1回の読み取りで得た計測値
+// 電文に無かった値はnilにする
+type Reading struct {
+	Timestamp            time.Time `json:"timestamp"`                        // 計測日時(スマートメーターの時刻が無ければ受信日時)
+	MeterTime            bool      `json:"meter_time"`                       // Timestampがスマートメーターの時刻ならtrue
+	InstantWatt          *int32    `json:"instant_watt,omitempty"`           // 瞬時電力(W)
+	AmpereR              *float64  `json:"ampere_r,omitempty"`               // 瞬時電流R相(A)
+	AmpereT              *float64  `json:"ampere_t,omitempty"`               // 瞬時電流T相(A 単相2線式では無い)
+	CumulativeKWh        *float64  `json:"cumulative_kwh,omitempty"`         // 積算電力量(正方向 kWh)
+	CumulativeReverseKWh *float64  `json:"cumulative_reverse_kwh,omitempty"` // 積算電力量(逆方向 kWh)
+	Coefficient          *uint32   `json:"coefficient,omitempty"`            // 係数(0xd3)
+	UnitPowersOfTen      *int      `json:"unit_powers_of_ten,omitempty"`     // 積算電力量単位(0xe1) 10の冪指数
+	DeltaWh              *float64  `json:"delta_wh,omitempty"`               // 前回の積算電力量からの増分(Wh 初回は無し)
+	Rssi                 int8      `json:"rssi"`                             // 受信時のRSSI(dBm)
+	// 換算前の積算電力量計測値(正方向は増分の計算にも使う)
+	cumulativeRaw        *uint64
+	cumulativeReverseRaw *uint64
+	// cumulativeRawが定時積算電力量計測値(0xea)ならtrue
+	cumulativeFixed bool
+}
+
+// echonet lite電文の全てのプロパティを1つのReadingにする
+// 定時積算電力量計測値(0xea)があればスマートメーターの計測日時を、無ければ今の日時を使う
+// 同じ電文に積算電力量単位(0xe1)があれば積算電力量をkWhに換算する(係数(0xd3)が無ければ1とする)
+// 解釈できるプロパティが1つも無ければエラー
+func (frame *EchonetliteFrame) ToReading() (Reading, error) {
+	r := Reading{Timestamp: time.Now()}
+	var fixed *FixedTimeCumulative
+	found := false
+	for _, edata := range slices.Concat(frame.edata, frame.getEdata) {
+		v, err := edata.Value()
+		if err != nil {
+			continue
+		}
+		switch edata.epc {
+		case 0xd3:
+			c := v.(uint32)
+			r.Coefficient = &c
+		case 0xe1:
+			p := v.(int)
+			r.UnitPowersOfTen = &p
+		case 0xe7:
+			w := v.(int32)
+			r.InstantWatt = &w
+		case 0xe8:
+			current := v.(InstantCurrent)
+			a := current.RAmpere()
+			r.AmpereR = &a
+			if t, ok := current.TAmpere(); ok {
+				r.AmpereT = &t
+			}
+		case 0xe0:
+			raw := v.(uint64)
+			r.cumulativeRaw = &raw
+		case 0xe3:
+			raw := v.(uint64)
+			r.cumulativeReverseRaw = &raw
+		case 0xea:
+			f := v.(FixedTimeCumulative)
+			fixed = &f
+			r.Timestamp = f.Time
+			r.MeterTime = true
+		default:
+			continue
+		}
+		found = true
+	}
+	if !found {
+		return r, fmt.Errorf("no measurement in frame(esv:0x%02x): %w", frame.esv, ErrValueNotAvailable)
+	}
+	// 積算電力量計測値(0xe0)が同じ電文に無ければ定時積算電力量計測値を使う
+	if r.cumulativeRaw == nil && fixed != nil {
+		r.cumulativeRaw = &fixed.Value
+		r.cumulativeFixed = true
+	}
+	if r.UnitPowersOfTen != nil {
+		scale := CumulativeScale{Coefficient: 1, PowersOfTen: *r.UnitPowersOfTen}
+		if r.Coefficient != nil {
+			scale.Coefficient = *r.Coefficient
+		}
+		r.scale(scale)
+	}
+	return r, nil
+}
+
+// 積算電力量計測値をkWhに換算する
+func (r *Reading) scale(scale CumulativeScale) {
+	if r.cumulativeRaw != nil {
+		kwh := scale.KWh(*r.cumulativeRaw)
+		r.CumulativeKWh = &kwh
+	}
+	if r.cumulativeReverseRaw != nil {
+		kwh := scale.KWh(*r.cumulativeReverseRaw)
+		r.CumulativeReverseKWh = &kwh
+	}
+}
+
+// echonet lite電文から計測値を取り出す
+// 定時積算電力量計測値(0xea)があればスマートメーターの計測日時を使い、無ければtimestampを使う
+// scaleがnilでなければ積算電力量をscaleで換算する(nilなら同じ電文の単位で換算できたときだけ含める)
+// 瞬時電力、瞬時電流、積算電力量のいずれも無ければfalseを返す
+func NewReading(frame *EchonetliteFrame, timestamp time.Time, scale *CumulativeScale, rssi int8) (Reading, bool) {
+	r, err := frame.ToReading()
+	if err != nil {
+		return r, false
+	}
+	if !r.MeterTime {
+		r.Timestamp = timestamp
+	}
+	r.Rssi = rssi
+	if scale != nil {
+		r.scale(*scale)
+	}
+	ok := r.InstantWatt != nil || r.AmpereR != nil || r.CumulativeKWh != nil || r.CumulativeReverseKWh != nil
+	return r, ok
+}
+
+// echonet lite電文から計測値を取り出す
+// 積算電力量計測値(0xe0)があれば前回からの増分も計算する
+// 増分の前後関係はスマートメーターの時刻(0xea)と混ぜずにtimestamp(受信日時)で判断するので、
+// 定時積算電力量計測値(0xea)は増分の計算に使わない
+func (m *Meter) reading(frame *EchonetliteFrame, timestamp time.Time) (Reading, bool) {
+	var scale *CumulativeScale
+	if s, err := m.CumulativeScale(); err == nil {
+		scale = &s
+	}
+	r, ok := NewReading(frame, timestamp, scale, m.LinkQuality())
+	if ok && r.cumulativeRaw != nil && !r.cumulativeFixed {
+		if wh, ok := m.CumulativeDeltaWh(*r.cumulativeRaw, timestamp); ok {
+			r.DeltaWh = &wh
+		}
+	}
+	return r, ok
+}
+
+// 計測値の出力先
+type Sink interface {
+	Publish(ctx context.Context, r Reading) error
+}
+
+// 1行に1つのJSONオブジェクトで出力する
+type JSONSink struct {
+	encoder *json.Encoder
+}
+
+func NewJSONSink(w io.Writer) *JSONSink {
+	return &JSONSink{encoder: json.NewEncoder(w)}
+}
+
+func (s *JSONSink) Publish(ctx context.Context, r Reading) error {
+	return s.encoder.Encode(r)
+}
+
+// CSVで出力する
+// 最初の出力の前に見出し行を出す
+type CSVSink struct {
+	writer *csv.Writer
+	header sync.Once
+}
+
+func NewCSVSink(w io.Writer) *CSVSink {
+	return &CSVSink{writer: csv.NewWriter(w)}
+}
+
+func (s *CSVSink) Publish(ctx context.Context, r Reading) error {
+	s.header.Do(func() {
+		s.writer.Write([]string{"timestamp", "meter_time", "instant_watt", "ampere_r", "ampere_t", "cumulative_kwh", "cumulative_reverse_kwh", "delta_wh", "rssi"})
+	})
+	float := func(p *float64) string {
+		if p == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*p, 'f', -1, 64)
+	}
+	watt := ""
+	if r.InstantWatt != nil {
+		watt = strconv.Itoa(int(*r.InstantWatt))
+	}
+	s.writer.Write([]string{
+		r.Timestamp.Format(time.RFC3339),
+		strconv.FormatBool(r.MeterTime),
+		watt,
+		float(r.AmpereR),
+		float(r.AmpereT),
+		float(r.CumulativeKWh),
+		float(r.CumulativeReverseKWh),
+		float(r.DeltaWh),
+		strconv.Itoa(int(r.Rssi)),
+	})
+	s.writer.Flush()
+	return s.writer.Error()
+}
+
+// 複数の出力先にまとめて出力する
+// 失敗した出力先があっても残りには出力する
+type MultiSink []Sink
+
+func (ms MultiSink) Publish(ctx context.Context, r Reading) error {
+	var errs []error
+	for _, s := range ms {
+		if err := s.Publish(ctx, r); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// reportで出力したあとに計測値をsinkに出力する関数を返す
+// sinkがnilならreportをそのまま返す
+func withSink(ctx context.Context, report func(*EchonetliteFrame), sink Sink, meter *Meter) func(*EchonetliteFrame) {
+	if sink == nil {
+		return report
+	}
+	return func(frame *EchonetliteFrame) {
+		report(frame)
+		r, ok := meter.reading(frame, time.Now())
+		if !ok {
+			return
+		}
+		if err := sink.Publish(ctx, r); err != nil {
+			slog.Error("Publish", "err", err)
+		}
+	}
+}
+
+// reportを1つずつ呼ぶようにする
+// 通知(INF, INFC)は受信ゴルーチンから、要求に対する応答は読み取りループから出力するので、
+// 同時に呼ばれてもcsv.Writerなどの出力先を同時に使わないようにする
+func serializeReport(report func(*EchonetliteFrame)) func(*EchonetliteFrame) {
+	var mu sync.Mutex
+	return func(frame *EchonetliteFrame) {
+		mu.Lock()
+		defer mu.Unlock()
+		report(frame)
+	}
+}
+
+// --sinkの指定から出力先を作る
+// 指定は"json"や"csv"(標準出力)か、"csv:FILE"のように出力するファイルを付ける
+// 返す関数で開いたファイルを閉じる
+// 標準出力に出すものがあればtoStdoutをtrueにする
+func openSinks(specs []string) (sink MultiSink, closeAll func(), toStdout bool, err error) {
+	var files []*os.File
+	closeAll = func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+	for _, spec := range specs {
+		kind, path, hasPath := strings.Cut(spec, ":")
+		var w io.Writer = os.Stdout
+		if hasPath {
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+			if err != nil {
+				closeAll()
+				return nil, nil, false, err
+			}
+			files = append(files, f)
+			w = f
+		} else {
+			toStdout = true
+		}
+		switch kind {
+		case "json":
+			sink = append(sink, NewJSONSink(w))
+		case "csv":
+			s := NewCSVSink(w)
+			// 追記するファイルに既に書いてあれば見出し行は出さない
+			if hasPath {
+				if fi, err := files[len(files)-1].Stat(); err == nil && fi.Size() > 0 {
+					s.header.Do(func() {})
+				}
+			}
+			sink = append(sink, s)
+		default:
+			closeAll()
+			return nil, nil, false, fmt.Errorf("unknown sink: %s", spec)
+		}
+	}
+	return sink, closeAll, toStdout, nil
+}